@@ -0,0 +1,212 @@
+package uhttp
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// AcceptPolicy restricts the senders from which a Transport accepts responses.  This matters
+// mostly for multicast requests, where any host on the network may answer.  Packets that fail
+// any of the checks are discarded before they are delivered.
+type AcceptPolicy struct {
+	// Allow, if non-empty, lists the only networks from which responses are accepted.
+	Allow []netip.Prefix
+
+	// Deny lists networks from which responses are never accepted.  It takes precedence over
+	// Allow.
+	Deny []netip.Prefix
+
+	// OnLink accepts responses only from senders in a subnet connected to the interface on
+	// which the response arrived.  Where the receiving interface isn't known, as on platforms
+	// that don't report it or for connections opened with Transport.DialContext, the check is
+	// weaker: if the request's destination names an interface (as in "[ff02::c%eth0]:1900"),
+	// that interface's subnets are used, and otherwise those of every interface on the host,
+	// so that a forged sender in any attached subnet is accepted.
+	OnLink bool
+
+	// MatchLocation accepts responses carrying a LOCATION header only if its host is the
+	// sender's IP address, so that a host cannot direct us to a device description elsewhere.
+	// Responses without a LOCATION header are unaffected.
+	MatchLocation bool
+}
+
+// RejectReason says why a packet was rejected by an AcceptPolicy.
+type RejectReason int
+
+const (
+	RejectDenied           RejectReason = iota + 1 // sender is in AcceptPolicy.Deny
+	RejectNotAllowed                               // sender is not in AcceptPolicy.Allow
+	RejectOffLink                                  // sender is not in a connected subnet
+	RejectLocationMismatch                         // LOCATION host is not the sender
+	RejectBadSignature                             // signature missing or invalid per Transport.Signer
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectDenied:
+		return "denied"
+	case RejectNotAllowed:
+		return "not allowed"
+	case RejectOffLink:
+		return "off link"
+	case RejectLocationMismatch:
+		return "location mismatch"
+	case RejectBadSignature:
+		return "bad signature"
+	}
+	return "unknown"
+}
+
+// interfacePrefixes returns the subnets connected to the interface named zone, or to all
+// interfaces if zone is empty.  It is a variable so that tests may replace it.
+var interfacePrefixes = func(zone string) ([]netip.Prefix, error) {
+	var ifaces []net.Interface
+	if zone != "" {
+		ifi, err := net.InterfaceByName(zone)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []net.Interface{*ifi}
+	} else {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return nil, err
+		}
+	}
+	var prefixes []netip.Prefix
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				ip, _ := netip.AddrFromSlice(ipn.IP)
+				ones, _ := ipn.Mask.Size()
+				prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ones).Masked())
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+// interfaceName returns the name of the interface with the given index.  It is a variable so
+// that tests may replace it.
+var interfaceName = func(index int) (string, error) {
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return "", err
+	}
+	return ifi.Name, nil
+}
+
+// acceptor applies an AcceptPolicy to the packets received for one request.
+type acceptor struct {
+	policy *AcceptPolicy
+	zone   string
+
+	// links holds the connected subnets of each receiving interface, by index, looked up on
+	// first use.  Index 0 holds those used when the interface isn't known.
+	links map[int][]netip.Prefix
+}
+
+func newAcceptor(policy *AcceptPolicy, dest *net.UDPAddr) *acceptor {
+	if policy == nil {
+		return nil
+	}
+	a := &acceptor{policy: policy}
+	if dest != nil {
+		a.zone = dest.Zone
+	}
+	return a
+}
+
+// senderIP returns the IP address of sender.
+func senderIP(sender net.Addr) (netip.Addr, bool) {
+	if u, ok := sender.(*net.UDPAddr); ok {
+		ip, ok := netip.AddrFromSlice(u.IP)
+		return ip.Unmap(), ok
+	}
+	ap, err := netip.ParseAddrPort(sender.String())
+	return ap.Addr().Unmap(), err == nil
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(ip) })
+}
+
+// linksFor returns the subnets connected to the interface with index ifIndex, or if that is 0,
+// to the interface named by the destination's zone, or to every interface.
+func (a *acceptor) linksFor(ifIndex int) []netip.Prefix {
+	if links, ok := a.links[ifIndex]; ok {
+		return links
+	}
+	if a.links == nil {
+		a.links = make(map[int][]netip.Prefix)
+	}
+	zone := a.zone
+	if ifIndex > 0 {
+		name, err := interfaceName(ifIndex)
+		if err != nil {
+			a.links[ifIndex] = nil
+			return nil
+		}
+		zone = name
+	}
+	links, _ := interfacePrefixes(zone)
+	a.links[ifIndex] = links
+	return links
+}
+
+// checkSender applies the checks that depend only on the sender's address and the index of
+// the interface the packet arrived on, or 0 if that isn't known.  Returns 0 if the packet is
+// acceptable.  A nil acceptor accepts everything.
+func (a *acceptor) checkSender(sender net.Addr, ifIndex int) RejectReason {
+	if a == nil {
+		return 0
+	}
+	p := a.policy
+	if len(p.Allow) == 0 && len(p.Deny) == 0 && !p.OnLink {
+		return 0
+	}
+	ip, ok := senderIP(sender)
+	if !ok {
+		return RejectNotAllowed
+	}
+	if containsAddr(p.Deny, ip) {
+		return RejectDenied
+	}
+	if len(p.Allow) > 0 && !containsAddr(p.Allow, ip) {
+		return RejectNotAllowed
+	}
+	if p.OnLink && !containsAddr(a.linksFor(ifIndex), ip) {
+		return RejectOffLink
+	}
+	return 0
+}
+
+// checkResponse applies the checks that depend on the content of res.  Returns 0 if the
+// response is acceptable.
+func (a *acceptor) checkResponse(sender net.Addr, res *http.Response) RejectReason {
+	if a == nil || !a.policy.MatchLocation {
+		return 0
+	}
+	loc := res.Header.Get("Location")
+	if loc == "" {
+		return 0
+	}
+	u, err := url.Parse(strings.TrimSpace(loc))
+	if err != nil {
+		return RejectLocationMismatch
+	}
+	host, err := netip.ParseAddr(u.Hostname())
+	ip, ok := senderIP(sender)
+	if err != nil || !ok || host.Unmap().WithZone("") != ip.WithZone("") {
+		return RejectLocationMismatch
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package uhttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestAcceptorCheckSender(t *testing.T) {
+	oldPrefixes, oldName := interfacePrefixes, interfaceName
+	defer func() { interfacePrefixes, interfaceName = oldPrefixes, oldName }()
+	interfacePrefixes = func(zone string) ([]netip.Prefix, error) {
+		switch zone {
+		case "eth0":
+			return []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}, nil
+		case "eth1":
+			return []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, nil
+		}
+		return []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("10.1.0.0/16")}, nil
+	}
+	interfaceName = func(index int) (string, error) {
+		switch index {
+		case 2:
+			return "eth0", nil
+		case 3:
+			return "eth1", nil
+		}
+		return "", errors.New("no such interface")
+	}
+
+	udp := func(s string) net.Addr { return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s)) }
+	policy := &AcceptPolicy{
+		Allow:  []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("10.0.0.0/8")},
+		Deny:   []netip.Prefix{netip.MustParsePrefix("192.168.1.66/32")},
+		OnLink: true,
+	}
+	cases := []struct {
+		sender  string
+		zone    string
+		ifIndex int
+		want    RejectReason
+	}{
+		{"192.168.1.5:1900", "", 0, 0},
+		{"192.168.1.66:1900", "", 0, RejectDenied},
+		{"172.16.0.1:1900", "", 0, RejectNotAllowed},
+		{"192.168.2.5:1900", "", 0, RejectOffLink},
+		{"10.1.2.3:1900", "eth1", 0, 0},
+		{"192.168.1.5:1900", "eth1", 0, RejectOffLink},
+		{"[::ffff:192.168.1.5]:1900", "", 0, 0},
+		// The receiving interface, when known, decides.
+		{"192.168.1.5:1900", "", 2, 0},
+		{"10.1.2.3:1900", "", 2, RejectOffLink},
+		{"10.1.2.3:1900", "", 3, 0},
+		{"192.168.1.5:1900", "", 9, RejectOffLink},
+	}
+	for _, c := range cases {
+		a := newAcceptor(policy, &net.UDPAddr{Zone: c.zone})
+		if got := a.checkSender(udp(c.sender), c.ifIndex); got != c.want {
+			t.Errorf("checkSender(%s, zone %q, interface %d) = %v, want %v", c.sender, c.zone, c.ifIndex, got, c.want)
+		}
+	}
+
+	var none *acceptor
+	if got := none.checkSender(udp("1.2.3.4:1"), 0); got != 0 {
+		t.Errorf("nil acceptor rejected with %v", got)
+	}
+}
+
+func TestAcceptorCheckResponse(t *testing.T) {
+	a := newAcceptor(&AcceptPolicy{MatchLocation: true}, nil)
+	sender := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 1900}
+	cases := []struct {
+		location string
+		want     RejectReason
+	}{
+		{"", 0},
+		{"http://192.168.1.5:80/desc.xml", 0},
+		{"http://192.168.1.6:80/desc.xml", RejectLocationMismatch},
+		{"http://example.com/desc.xml", RejectLocationMismatch},
+		{"::not a url", RejectLocationMismatch},
+	}
+	for _, c := range cases {
+		res := &http.Response{Header: http.Header{}}
+		if c.location != "" {
+			res.Header.Set("Location", c.location)
+		}
+		if got := a.checkResponse(sender, res); got != c.want {
+			t.Errorf("checkResponse(%q) = %v, want %v", c.location, got, c.want)
+		}
+	}
+}
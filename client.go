@@ -1,6 +1,9 @@
 package uhttp
 
 import (
+	"context"
+	"errors"
+	"iter"
 	"net"
 	"net/http"
 	"time"
@@ -30,6 +33,144 @@ func (c *Client) Do(r *http.Request, wait time.Duration, fn func(sender net.Addr
 	return c.Transport.RoundTripMulti(r, wait, fn)
 }
 
+// Response is a response delivered by Client.Responses or Client.ResponseChan, along with the
+// address of the sender it was received from.
+type Response struct {
+	*http.Response
+	Sender net.Addr
+}
+
+// Responses issues r, waits up to wait, and returns an iterator over the responses received.
+// If an error occurs, it is yielded with a zero Response as the final element.  Breaking out of
+// the loop behaves as if Stop were returned from a Do callback: the request is canceled and its
+// socket closed before the loop exits.
+func (c *Client) Responses(r *http.Request, wait time.Duration) iter.Seq2[Response, error] {
+	return func(yield func(Response, error) bool) {
+		stopped := false
+		err := c.Do(r, wait, func(sender net.Addr, resp *http.Response) error {
+			if !yield(Response{resp, sender}, nil) {
+				stopped = true
+				return Stop
+			}
+			return nil
+		})
+		if err != nil && !stopped {
+			yield(Response{}, err)
+		}
+	}
+}
+
+// ResponseChan issues r, waits up to wait, and delivers the responses received on the returned
+// channel, which is closed once the request completes.  The final error, or nil, is then sent
+// on the second channel.
+//
+// The response channel is unbuffered.  While the caller is not receiving from it, no further
+// packets are read, and any that arrive queue in the socket's receive buffer, where the
+// operating system may drop them once it fills.  To stop early, cancel r.Context(); both
+// channels will then be closed without requiring further receives, and the error channel will
+// report the context's error.
+func (c *Client) ResponseChan(r *http.Request, wait time.Duration) (<-chan Response, <-chan error) {
+	ch := make(chan Response)
+	errc := make(chan error, 1)
+	ctx := r.Context()
+	go func() {
+		defer close(errc)
+		defer close(ch)
+		errc <- c.Do(r, wait, func(sender net.Addr, resp *http.Response) error {
+			select {
+			case ch <- Response{resp, sender}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return ch, errc
+}
+
+// CollectOptions controls when Client.Collect stops gathering responses.
+type CollectOptions struct {
+	// Wait is the longest Collect will wait for responses, as with Do.
+	Wait time.Duration
+
+	// MaxResponses ends collection once this many responses have been gathered.  A zero value
+	// means no limit.
+	MaxResponses int
+
+	// MaxPerSender discards further responses from a sender once it has contributed this many.
+	// Senders are identified by IP address.  A zero value means no limit.
+	MaxPerSender int
+
+	// IdleTimeout ends collection once no new response has been gathered for this long.  The
+	// timer starts when the request is issued, and runs on the Transport's Clock.  A zero
+	// value disables the idle timeout.
+	IdleTimeout time.Duration
+}
+
+var errIdle = errors.New("uhttp: idle timeout")
+
+// Collect issues r and gathers the responses received, until opts.Wait is reached, one of the
+// other limits in opts is met, or r.Context() expires.  If an error occurs, the responses
+// gathered so far are returned along with it.
+func (c *Client) Collect(r *http.Request, opts CollectOptions) ([]Response, error) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+
+	var idle Timer
+	if opts.IdleTimeout > 0 {
+		idle = c.clock().NewTimer(opts.IdleTimeout)
+		defer idle.Stop()
+		go func() {
+			select {
+			case <-idle.C():
+				cancel(errIdle)
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var all []Response
+	perSender := make(map[string]int)
+	err := c.Do(r.WithContext(ctx), opts.Wait, func(sender net.Addr, resp *http.Response) error {
+		if opts.MaxPerSender > 0 {
+			key := senderKey(sender)
+			if perSender[key] >= opts.MaxPerSender {
+				return nil
+			}
+			perSender[key]++
+		}
+		all = append(all, Response{resp, sender})
+		if opts.MaxResponses > 0 && len(all) >= opts.MaxResponses {
+			return Stop
+		}
+		if idle != nil {
+			idle.Reset(opts.IdleTimeout)
+		}
+		return nil
+	})
+	if err != nil && context.Cause(ctx) == errIdle {
+		err = nil
+	}
+	return all, err
+}
+
+// clock returns the Clock of c.Transport, if it is a *Transport.
+func (c *Client) clock() Clock {
+	if t, ok := c.Transport.(*Transport); ok {
+		return t.clock()
+	}
+	return SystemClock
+}
+
+// senderKey identifies sender for the purpose of per-sender limits.  This is its IP address,
+// since a device may respond from more than one port.
+func senderKey(sender net.Addr) string {
+	if u, ok := sender.(*net.UDPAddr); ok {
+		return u.IP.String()
+	}
+	return sender.String()
+}
+
 // DefaultClient is the Client used by the top-level Do and Get functions.
 var DefaultClient = &Client{
 	Transport: DefaultTransport,
@@ -1,14 +1,17 @@
 package uhttp_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"testing"
 	"time"
 
 	"github.com/dnesting/uhttp"
+	"github.com/dnesting/uhttp/uhttptest"
 )
 
 func ExampleClient_sSDP() {
@@ -43,3 +46,152 @@ func ExampleClient_sSDP() {
 		fmt.Printf("error: %s\n", err)
 	}
 }
+
+func okResponder([]byte) []byte {
+	return []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+}
+
+func TestClientResponses(t *testing.T) {
+	addr, _ := listenUDP(t, okResponder)
+	client := uhttp.Client{
+		Transport: &uhttp.Transport{Repeat: uhttp.RepeatAfter(10*time.Millisecond, 0)},
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+
+	start := time.Now()
+	var count int
+	for res, err := range client.Responses(req, 10*time.Second) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.StatusCode != 200 || res.Sender == nil {
+			t.Errorf("expected 200 response with sender, got %d from %v", res.StatusCode, res.Sender)
+		}
+		if count++; count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("expected 2 responses, got %d", count)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("breaking out of the loop should end the request, took %v", elapsed)
+	}
+}
+
+func TestClientResponsesError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/no-host", nil)
+	var errs int
+	for res, err := range uhttp.DefaultClient.Responses(req, time.Second) {
+		if err == nil || res.Response != nil {
+			t.Errorf("expected only an error, got %v, %v", res, err)
+		}
+		errs++
+	}
+	if errs != 1 {
+		t.Errorf("expected a single error, got %d", errs)
+	}
+}
+
+func TestClientResponseChan(t *testing.T) {
+	addr, _ := listenUDP(t, okResponder)
+	client := uhttp.Client{
+		Transport: &uhttp.Transport{Repeat: uhttp.RepeatAfter(10*time.Millisecond, 2)},
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+
+	ch, errc := client.ResponseChan(req, 500*time.Millisecond)
+	var count int
+	for res := range ch {
+		if res.StatusCode != 200 {
+			t.Errorf("expected status 200, got %d", res.StatusCode)
+		}
+		count++
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 responses, got %d", count)
+	}
+}
+
+func TestClientResponseChanCancel(t *testing.T) {
+	addr, _ := listenUDP(t, okResponder)
+	client := uhttp.Client{
+		Transport: &uhttp.Transport{Repeat: uhttp.RepeatAfter(10*time.Millisecond, 0)},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/", nil)
+
+	ch, errc := client.ResponseChan(req, 10*time.Second)
+	<-ch
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("expected response channel to be closed")
+	}
+}
+
+func TestClientCollect(t *testing.T) {
+	addr, _ := listenUDP(t, okResponder)
+	client := uhttp.Client{
+		Transport: &uhttp.Transport{Repeat: uhttp.RepeatAfter(10*time.Millisecond, 0)},
+	}
+
+	type testcase struct {
+		desc     string
+		opts     uhttp.CollectOptions
+		expected int
+	}
+	cases := []testcase{
+		{"max responses", uhttp.CollectOptions{Wait: 10 * time.Second, MaxResponses: 3}, 3},
+		{"max per sender", uhttp.CollectOptions{Wait: 200 * time.Millisecond, MaxPerSender: 1}, 1},
+		{"idle timeout", uhttp.CollectOptions{Wait: 10 * time.Second, MaxPerSender: 2, IdleTimeout: 100 * time.Millisecond}, 2},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		start := time.Now()
+		all, err := client.Collect(req, c.opts)
+		if err != nil {
+			t.Errorf("%s: did not expect error, got %v", c.desc, err)
+		}
+		if len(all) != c.expected {
+			t.Errorf("%s: expected %d responses, got %d", c.desc, c.expected, len(all))
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: should have returned early, took %v", c.desc, elapsed)
+		}
+	}
+}
+
+func TestClientCollectIdleClock(t *testing.T) {
+	addr, _ := listenUDP(t, okResponder)
+	clock := uhttptest.NewFakeClock(time.Unix(0, 0))
+	client := uhttp.Client{Transport: &uhttp.Transport{Clock: clock}}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+
+	type result struct {
+		all []uhttp.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		all, err := client.Collect(req, uhttp.CollectOptions{Wait: time.Hour, IdleTimeout: 10 * time.Millisecond})
+		done <- result{all, err}
+	}()
+	// The idle timeout runs on the fake clock, so real time passing doesn't end collection.
+	select {
+	case r := <-done:
+		t.Fatalf("Collect returned %d responses, %v before the clock advanced", len(r.all), r.err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	clock.Advance(10 * time.Millisecond)
+	r := <-done
+	if r.err != nil || len(r.all) != 1 {
+		t.Errorf("Collect = %d responses, %v; want 1, nil", len(r.all), r.err)
+	}
+}
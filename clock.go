@@ -0,0 +1,44 @@
+package uhttp
+
+import "time"
+
+// Clock is a source of time for a Transport.  It exists so that tests can substitute a fake
+// clock and exercise wait windows and repeat schedules without sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for d to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer creates a Timer that will send the current time on its channel after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of *time.Timer used by this package.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing.  Returns false if the timer has already fired or
+	// been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after d.  Returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// SystemClock is a Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTimer(d time.Duration) Timer         { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
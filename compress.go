@@ -0,0 +1,216 @@
+package uhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxDecompressedSize is the default limit on the size of a decompressed body.
+const defaultMaxDecompressedSize = 1 << 20
+
+// acceptEncoding is the Accept-Encoding value sent when compression is enabled.
+const acceptEncoding = "gzip, deflate"
+
+// ErrDecompressedTooLarge is reported when a compressed body would decompress to more than the
+// permitted size.
+var ErrDecompressedTooLarge = errors.New("uhttp: decompressed body too large")
+
+// validEncoding reports whether enc is a content coding supported by this package.
+func validEncoding(enc string) bool {
+	return enc == "gzip" || enc == "deflate"
+}
+
+// compressBody returns b compressed with the content coding enc.
+func compressBody(enc string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		// HTTP's "deflate" is the zlib format, not raw deflate.
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("uhttp: unsupported content coding %q", enc)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBody reads body, compressed with the content coding enc, and returns its
+// decompressed contents.  If those would be larger than limit, returns an error wrapping
+// ErrDecompressedTooLarge without reading any further.
+func decompressBody(enc string, body io.Reader, limit int) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(enc) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate":
+		r, err = zlib.NewReader(body)
+	default:
+		return nil, fmt.Errorf("uhttp: unsupported content coding %q", enc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("uhttp: decompress %s: %v", enc, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("uhttp: decompress %s: %v", enc, err)
+	}
+	if len(b) > limit {
+		return nil, fmt.Errorf("%w: limit %d", ErrDecompressedTooLarge, limit)
+	}
+	return b, nil
+}
+
+// negotiateEncoding returns the content coding to use for a response to a request with the
+// given Accept-Encoding header, or "" if the body should not be compressed.
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		enc, params, _ := strings.Cut(part, ";")
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc == "x-gzip" {
+			enc = "gzip"
+		}
+		if !validEncoding(enc) {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		// Prefer gzip when equally acceptable.
+		if q > 0 && (q > bestQ || (q == bestQ && enc == "gzip")) {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// decodeBody replaces the body of a message compressed with supported content codings with
+// its decompressed contents, and removes the Content-Encoding header.  Codings listed in
+// Content-Encoding are undone in reverse order, and identity is ignored.  Returns the new body
+// and its length, or ok=false if the body isn't compressed.
+func decodeBody(h http.Header, body io.Reader, limit int) (_ io.ReadCloser, _ int64, ok bool, err error) {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			if enc = strings.TrimSpace(enc); enc != "" && !strings.EqualFold(enc, "identity") {
+				codings = append(codings, enc)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		h.Del("Content-Encoding")
+		return nil, 0, false, nil
+	}
+	var b []byte
+	for i := len(codings) - 1; i >= 0; i-- {
+		if b, err = decompressBody(codings[i], body, limit); err != nil {
+			return nil, 0, false, err
+		}
+		body = bytes.NewReader(b)
+	}
+	h.Del("Content-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	return io.NopCloser(bytes.NewReader(b)), int64(len(b)), true, nil
+}
+
+func (t *Transport) maxDecompressedSize() int {
+	if t.MaxDecompressedSize > 0 {
+		return t.MaxDecompressedSize
+	}
+	return defaultMaxDecompressedSize
+}
+
+// compressRequest returns req with its body compressed per t.RequestEncoding and an
+// Accept-Encoding header added if t.Compression is set.  req is returned as is if neither
+// applies.
+func (t *Transport) compressRequest(req *http.Request) (*http.Request, error) {
+	compress := t.RequestEncoding != "" && req.Body != nil && req.Body != http.NoBody &&
+		req.Header.Get("Content-Encoding") == ""
+	accept := t.Compression && req.Header.Get("Accept-Encoding") == ""
+	oh := ContextOrderedHeader(req.Context())
+	if oh != nil {
+		compress = compress && !oh.Has("Content-Encoding")
+		accept = accept && !oh.Has("Accept-Encoding")
+	}
+	if !compress && !accept {
+		return req, nil
+	}
+
+	var added OrderedHeader
+	out := req.Clone(req.Context())
+	if accept {
+		out.Header.Set("Accept-Encoding", acceptEncoding)
+		added.Add("Accept-Encoding", acceptEncoding)
+	}
+	if compress {
+		defer req.Body.Close()
+		limit := t.maxDecompressedSize()
+		b, err := io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > limit {
+			return nil, fmt.Errorf("%w of %d", ErrRequestTooLarge, limit)
+		}
+		if b, err = compressBody(t.RequestEncoding, b); err != nil {
+			return nil, err
+		}
+		out.Header.Set("Content-Encoding", t.RequestEncoding)
+		added.Add("Content-Encoding", t.RequestEncoding)
+		out.Body = io.NopCloser(bytes.NewReader(b))
+		out.ContentLength = int64(len(b))
+	}
+	if oh != nil {
+		out = out.WithContext(WithOrderedHeader(out.Context(), append(oh[:len(oh):len(oh)], added...)))
+	}
+	return out, nil
+}
+
+// encodeRequest prepares req for sending, compressing and then signing it as configured.
+// Returns the nonce of the request's signature, if it was signed.
+func (t *Transport) encodeRequest(req *http.Request) (*http.Request, string, error) {
+	req, err := t.compressRequest(req)
+	if err != nil || t.Signer == nil {
+		return req, "", err
+	}
+	if err := t.checkSigned(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, "", err
+	}
+	return t.Signer.signRequest(req, t.sentHost(req), t.maxMessageSize())
+}
+
+// decodeResponse decompresses the body of res if t.Compression is set and it carries a
+// supported Content-Encoding.
+func (t *Transport) decodeResponse(res *http.Response) error {
+	if !t.Compression {
+		return nil
+	}
+	body, n, ok, err := decodeBody(res.Header, res.Body, t.maxDecompressedSize())
+	if ok {
+		res.Body, res.ContentLength, res.Uncompressed = body, n, true
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"status":"ok"}`), 1000)
+	for _, enc := range []string{"gzip", "deflate"} {
+		b, err := compressBody(enc, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) >= len(data) {
+			t.Errorf("%s: compressed to %d bytes from %d", enc, len(b), len(data))
+		}
+		got, err := decompressBody(enc, bytes.NewReader(b), len(data))
+		if err != nil {
+			t.Fatalf("%s: %v", enc, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip differs", enc)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// A small packet that expands enormously.
+	bomb, _ := compressBody("gzip", make([]byte, 10<<20))
+	if len(bomb) > 65507 {
+		t.Fatalf("bomb is %d bytes", len(bomb))
+	}
+	_, err := decompressBody("gzip", bytes.NewReader(bomb), 1<<20)
+	if !errors.Is(err, ErrDecompressedTooLarge) {
+		t.Errorf("decompressBody = %v, want ErrDecompressedTooLarge", err)
+	}
+	if _, err := decompressBody("br", bytes.NewReader(bomb), 1<<20); err == nil {
+		t.Error("expected error for unsupported coding")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct{ accept, want string }{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, br", ""},
+		{"X-GZIP", "gzip"},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.accept); got != c.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", c.accept, got, c.want)
+		}
+	}
+}
+
+func TestEncodeRequest(t *testing.T) {
+	tr := &Transport{Compression: true, RequestEncoding: "gzip"}
+	body := strings.Repeat("hello ", 100)
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:1900/", strings.NewReader(body))
+	var buf bytes.Buffer
+	if err := tr.WriteRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Content-Encoding") != "" {
+		t.Error("caller's request was modified")
+	}
+
+	got, err := http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ae := got.Header.Get("Accept-Encoding"); ae != acceptEncoding {
+		t.Errorf("Accept-Encoding = %q", ae)
+	}
+	if got.ContentLength >= int64(len(body)) {
+		t.Errorf("Content-Length = %d, want less than %d", got.ContentLength, len(body))
+	}
+	b, n, ok, err := decodeBody(got.Header, got.Body, 1<<20)
+	if err != nil || !ok {
+		t.Fatalf("decodeBody = %v, %v", ok, err)
+	}
+	if plain, _ := io.ReadAll(b); string(plain) != body || n != int64(len(body)) {
+		t.Errorf("decoded body = %q (%d)", plain, n)
+	}
+}
+
+func TestDecodeBodyCodings(t *testing.T) {
+	plain := strings.Repeat("stacked ", 100)
+	gz, _ := compressBody("gzip", []byte(plain))
+	both, _ := compressBody("deflate", gz)
+
+	for _, tc := range []struct {
+		enc  []string
+		body []byte
+		ok   bool
+	}{
+		{[]string{"identity"}, []byte(plain), false},
+		{[]string{"gzip, identity"}, gz, true},
+		{[]string{"Identity", "gzip"}, gz, true},
+		{[]string{"gzip, deflate"}, both, true},
+		{[]string{"gzip", "deflate"}, both, true},
+	} {
+		h := http.Header{"Content-Encoding": tc.enc}
+		b, _, ok, err := decodeBody(h, bytes.NewReader(tc.body), 1<<20)
+		if err != nil || ok != tc.ok {
+			t.Errorf("%q: decodeBody = %v, %v; want ok=%v", tc.enc, ok, err, tc.ok)
+			continue
+		}
+		if h.Get("Content-Encoding") != "" {
+			t.Errorf("%q: Content-Encoding not removed", tc.enc)
+		}
+		if ok {
+			if got, _ := io.ReadAll(b); string(got) != plain {
+				t.Errorf("%q: decoded body = %q", tc.enc, got)
+			}
+		}
+	}
+
+	if _, _, _, err := decodeBody(http.Header{"Content-Encoding": {"br, gzip"}}, bytes.NewReader(gz), 1<<20); err == nil {
+		t.Error("expected an error for an unsupported coding in the stack")
+	}
+}
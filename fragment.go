@@ -0,0 +1,402 @@
+package uhttp
+
+// Fragmentation is an extension, understood only by uhttp clients and servers, that allows a
+// request or response body to span several datagrams.  Each fragment is a complete HTTP message
+// carrying the original start line and headers, a piece of the body, and these headers:
+//
+//	Uhttp-Message-Id: <id shared by all fragments of the message>
+//	Uhttp-Fragment: <index>/<count>
+//
+// The receiver reassembles the pieces and delivers a single message whose body is their
+// concatenation.  If pieces go missing, the receiver asks the sender to retransmit them with a
+// message of the form:
+//
+//	RESEND * HTTP/1.1
+//	Uhttp-Message-Id: <id>
+//	Uhttp-Missing: <index>,<index>,...
+//
+// A client indicates that it can reassemble fragmented responses by sending
+// Uhttp-Accept-Fragments with the largest datagram it will accept.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	messageIDHeader       = "Uhttp-Message-Id"
+	fragmentHeader        = "Uhttp-Fragment"
+	missingHeader         = "Uhttp-Missing"
+	acceptFragmentsHeader = "Uhttp-Accept-Fragments"
+	resendMethod          = "RESEND"
+
+	defaultMaxMessageSize  = 1 << 20
+	defaultFragmentTimeout = 2 * time.Second
+
+	// maxResends limits how many times the receiver will ask for the same missing pieces.
+	maxResends = 3
+
+	// minFragmentPayload is the smallest piece of body that a fragment other than the last may
+	// carry.  Together with the message size limit, it bounds the fragment count a receiver
+	// will accept.
+	minFragmentPayload = 256
+
+	// maxPartialMessages and maxPartialPerSender limit how many fragmented messages may be
+	// awaiting reassembly at once, in total and from any one sender.  maxUntrustedPartials
+	// limits those from untrusted senders, such as senders that have not yet proved they hold
+	// a Server's signing key, which may have only one each.
+	maxPartialMessages   = 64
+	maxPartialPerSender  = 4
+	maxUntrustedPartials = 8
+)
+
+// ErrFragmentTimeout is reported when a fragmented message could not be reassembled before
+// its pieces stopped arriving.
+var ErrFragmentTimeout = errors.New("uhttp: timeout reassembling fragmented message")
+
+// ErrMessageTooLarge is reported when a fragmented message would exceed the size permitted for
+// reassembly.
+var ErrMessageTooLarge = errors.New("uhttp: fragmented message too large")
+
+// ErrTooManyFragmented is reported when a fragment of a new message arrives while too many
+// others are already awaiting reassembly.
+var ErrTooManyFragmented = errors.New("uhttp: too many fragmented messages pending")
+
+// newMessageID returns a random identifier for a fragmented message.
+func newMessageID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// splitMessage splits the HTTP message in data into fragments no larger than limit, each
+// carrying the start line and headers of the original along with a piece of its body.
+func splitMessage(data []byte, id string, limit int) ([][]byte, error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, errors.New("uhttp: malformed message")
+	}
+	head, body := data[:end+2], data[end+4:]
+
+	// Drop the original Content-Length, since each fragment will have its own.
+	var kept []byte
+	for len(head) > 0 {
+		line, rest, _ := bytes.Cut(head, []byte("\r\n"))
+		head = rest
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(name), "Content-Length") {
+			continue
+		}
+		kept = append(kept, line...)
+		kept = append(kept, "\r\n"...)
+	}
+
+	// Leave room for the headers we'll add, assuming the worst case for the numbers in them.
+	overhead := len(kept) + len("Content-Length: 65507\r\n") +
+		len(messageIDHeader+": \r\n") + len(id) +
+		len(fragmentHeader+": 65507/65507\r\n") + len("\r\n")
+	chunk := limit - overhead
+	if chunk < minFragmentPayload {
+		return nil, fmt.Errorf("%w of %d", ErrRequestTooLarge, limit)
+	}
+	count := (len(body) + chunk - 1) / chunk
+	if count > maxFragments(len(body)) {
+		return nil, ErrMessageTooLarge
+	}
+
+	frags := make([][]byte, count)
+	for i := range frags {
+		piece := body[i*chunk : min((i+1)*chunk, len(body))]
+		f := make([]byte, 0, overhead+len(piece))
+		f = append(f, kept...)
+		f = appendField(f, "Content-Length", strconv.Itoa(len(piece)))
+		f = appendField(f, messageIDHeader, id)
+		f = appendField(f, fragmentHeader, strconv.Itoa(i)+"/"+strconv.Itoa(count))
+		f = append(f, "\r\n"...)
+		frags[i] = append(f, piece...)
+	}
+	return frags, nil
+}
+
+// maxFragments returns the largest number of fragments that a message body of size bytes may
+// be split into.
+func maxFragments(size int) int {
+	return min(maxPacketSize, max(1, (size+minFragmentPayload-1)/minFragmentPayload))
+}
+
+// parseFragment returns the message ID, index and count of the fragment with header h, and
+// whether h describes a fragment at all.
+func parseFragment(h http.Header) (id string, index, count int, ok bool) {
+	id = h.Get(messageIDHeader)
+	i, n, found := strings.Cut(h.Get(fragmentHeader), "/")
+	if id == "" || !found {
+		return "", 0, 0, false
+	}
+	index, err1 := strconv.Atoi(i)
+	count, err2 := strconv.Atoi(n)
+	if err1 != nil || err2 != nil || count <= 0 || index < 0 || index >= count {
+		return "", 0, 0, false
+	}
+	return id, index, count, true
+}
+
+// stripFragmentHeaders removes the fragmentation headers from h and sets its body to body,
+// turning the first fragment of a message into the reassembled whole.
+func stripFragmentHeaders(h http.Header, body []byte) (io.ReadCloser, int64) {
+	h.Del(messageIDHeader)
+	h.Del(fragmentHeader)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	return io.NopCloser(bytes.NewReader(body)), int64(len(body))
+}
+
+// newResend builds a RESEND message asking for the pieces of message id listed in missing.
+func newResend(id string, missing []int) []byte {
+	idx := make([]string, len(missing))
+	for i, n := range missing {
+		idx[i] = strconv.Itoa(n)
+	}
+	b := []byte(resendMethod + " * HTTP/1.1\r\n")
+	b = appendField(b, messageIDHeader, id)
+	b = appendField(b, missingHeader, strings.Join(idx, ","))
+	return append(b, "\r\n"...)
+}
+
+// isResend reports whether data is a RESEND message.
+func isResend(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(resendMethod+" "))
+}
+
+// parseResend returns the message ID and missing indexes requested by the RESEND message in
+// req.
+func parseResend(req *http.Request) (id string, missing []int) {
+	id = req.Header.Get(messageIDHeader)
+	for _, s := range strings.Split(req.Header.Get(missingHeader), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			missing = append(missing, n)
+		}
+	}
+	return id, missing
+}
+
+// resendFragments writes the fragments of frags listed in missing to addr via conn.
+func resendFragments(conn net.PacketConn, addr net.Addr, frags [][]byte, missing []int) error {
+	for _, i := range missing {
+		if i >= 0 && i < len(frags) {
+			if _, err := writeTo(conn, frags[i], addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resendLimiter decides which RESENDs the sender of a fragmented request answers, so that
+// spoofed RESENDs can't turn it into an amplifier.  Only the destination of a unicast request
+// may ask, each sender may ask at most maxResends times, and the fragments resent in total
+// are limited to maxResends copies of the request.
+type resendLimiter struct {
+	dest   *net.UDPAddr // nil if the request was multicast or broadcast
+	asked  map[string]int
+	budget byteBudget
+}
+
+func newResendLimiter(dest *net.UDPAddr, size int) *resendLimiter {
+	l := &resendLimiter{asked: make(map[string]int), budget: byteBudget{left: maxResends * size}}
+	if !dest.IP.Equal(net.IPv4bcast) && !dest.IP.IsMulticast() {
+		l.dest = dest
+	}
+	return l
+}
+
+// allow reports whether the RESEND from sender asking for the fragments of frags listed in
+// missing should be answered, charging them to the budget if so.
+func (l *resendLimiter) allow(sender net.Addr, frags [][]byte, missing []int) bool {
+	if l.dest != nil {
+		u, ok := sender.(*net.UDPAddr)
+		if !ok || !u.IP.Equal(l.dest.IP) || u.Port != l.dest.Port {
+			return false
+		}
+	}
+	key := sender.String()
+	if l.asked[key] >= maxResends {
+		return false
+	}
+	n := 0
+	for _, i := range missing {
+		if i >= 0 && i < len(frags) {
+			n += len(frags[i])
+		}
+	}
+	if n == 0 || !l.budget.spend(n) {
+		return false
+	}
+	l.asked[key]++
+	return true
+}
+
+// writeTo writes b to addr via conn, which may be connected to addr already.
+func writeTo(conn net.PacketConn, b []byte, addr net.Addr) (int, error) {
+	if c, ok := conn.(net.Conn); ok && c.RemoteAddr() != nil {
+		return c.Write(b)
+	}
+	return conn.WriteTo(b, addr)
+}
+
+type fragmentKey struct {
+	sender string
+	id     string
+}
+
+// partialMessage is a fragmented message that has not yet been fully received.
+type partialMessage struct {
+	sender   net.Addr
+	head     any // the parsed first fragment to arrive
+	count    int
+	pieces   map[int][]byte // received so far, by index
+	size     int
+	started  time.Time
+	progress time.Time
+	resends  int
+	trusted  bool
+}
+
+// reassembler collects the fragments of messages until they are complete.  It is not safe for
+// concurrent use.
+type reassembler struct {
+	maxSize int
+	timeout time.Duration
+	partial map[fragmentKey]*partialMessage
+
+	// senders counts the messages in partial from each sender, and untrusted those from
+	// untrusted senders.
+	senders   map[string]int
+	untrusted int
+
+	// done remembers recently completed messages, so that late or repeated fragments of them
+	// are not mistaken for a new message.
+	done map[fragmentKey]time.Time
+}
+
+func newReassembler(maxSize int, timeout time.Duration) *reassembler {
+	if maxSize <= 0 {
+		maxSize = defaultMaxMessageSize
+	}
+	if timeout <= 0 {
+		timeout = defaultFragmentTimeout
+	}
+	return &reassembler{maxSize: maxSize, timeout: timeout, partial: make(map[fragmentKey]*partialMessage),
+		senders: make(map[string]int), done: make(map[fragmentKey]time.Time)}
+}
+
+// forget discards the partial message with key.
+func (r *reassembler) forget(key fragmentKey) {
+	if m := r.partial[key]; m != nil && !m.trusted {
+		r.untrusted--
+	}
+	delete(r.partial, key)
+	if r.senders[key.sender]--; r.senders[key.sender] <= 0 {
+		delete(r.senders, key.sender)
+	}
+}
+
+// add records a fragment of message id from sender.  head is the parsed fragment, and body
+// its piece of the message body.  Once all fragments have arrived, returns the head of the
+// first to arrive along with the reassembled body.  Untrusted senders are held to tighter
+// limits on the messages they may have pending.
+func (r *reassembler) add(now time.Time, sender net.Addr, trusted bool, id string, index, count int, head any, body []byte) (any, []byte, error) {
+	key := fragmentKey{sender.String(), id}
+	if _, ok := r.done[key]; ok {
+		return nil, nil, nil
+	}
+	m := r.partial[key]
+	if m == nil {
+		// The count comes from the peer, so don't trust it any further than the size limit
+		// allows.
+		if count > maxFragments(r.maxSize) {
+			return nil, nil, ErrMessageTooLarge
+		}
+		if len(r.partial) >= maxPartialMessages || r.senders[key.sender] >= maxPartialPerSender ||
+			!trusted && (r.untrusted >= maxUntrustedPartials || r.senders[key.sender] > 0) {
+			return nil, nil, ErrTooManyFragmented
+		}
+		m = &partialMessage{sender: sender, head: head, count: count, pieces: make(map[int][]byte), started: now, trusted: trusted}
+		r.partial[key] = m
+		r.senders[key.sender]++
+		if !trusted {
+			r.untrusted++
+		}
+	}
+	if _, dup := m.pieces[index]; count != m.count || dup {
+		return nil, nil, nil // inconsistent or duplicate
+	}
+	if m.size += len(body); m.size > r.maxSize {
+		r.forget(key)
+		return nil, nil, ErrMessageTooLarge
+	}
+	m.pieces[index] = body
+	m.progress = now
+	if len(m.pieces) < m.count {
+		return nil, nil, nil
+	}
+	r.forget(key)
+	r.done[key] = now
+	full := make([]byte, 0, m.size)
+	for i := range m.count {
+		full = append(full, m.pieces[i]...)
+	}
+	return m.head, full, nil
+}
+
+// resendRequest asks sender to retransmit the pieces of message id listed in missing.
+type resendRequest struct {
+	sender  net.Addr
+	id      string
+	missing []int
+}
+
+// poll returns requests for the pieces of messages that have made no progress recently, and
+// discards messages that have made no progress for r.timeout, returning their senders.
+func (r *reassembler) poll(now time.Time) (resends []resendRequest, expired []net.Addr) {
+	for key, t := range r.done {
+		if now.Sub(t) >= r.timeout {
+			delete(r.done, key)
+		}
+	}
+	for key, m := range r.partial {
+		idle := now.Sub(m.progress)
+		if idle >= r.timeout {
+			r.forget(key)
+			expired = append(expired, m.sender)
+			continue
+		}
+		if m.resends < maxResends && idle >= r.interval()*time.Duration(m.resends+1) {
+			var missing []int
+			for i := range m.count {
+				if _, ok := m.pieces[i]; !ok {
+					missing = append(missing, i)
+				}
+			}
+			m.resends++
+			resends = append(resends, resendRequest{m.sender, key.id, missing})
+		}
+	}
+	return
+}
+
+// interval is how often poll should be called while messages are pending.
+func (r *reassembler) interval() time.Duration {
+	return r.timeout / (maxResends + 1)
+}
+
+// pending reports whether any messages are incomplete.
+func (r *reassembler) pending() bool {
+	return len(r.partial) > 0
+}
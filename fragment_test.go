@@ -0,0 +1,246 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSplitMessage(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	msg := []byte("POST /x HTTP/1.1\r\nHost: a\r\nContent-Length: 10000\r\n\r\n")
+	msg = append(msg, body...)
+
+	frags, err := splitMessage(msg, "abc", 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) < 7 {
+		t.Fatalf("got %d fragments, want at least 7", len(frags))
+	}
+
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	r := newReassembler(0, 0)
+	now := time.Now()
+	var got []byte
+	// Deliver them in reverse order.
+	for i := len(frags) - 1; i >= 0; i-- {
+		if len(frags[i]) > 1500 {
+			t.Errorf("fragment %d is %d bytes, want <= 1500", i, len(frags[i]))
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(frags[i])))
+		if err != nil {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+		id, index, count, ok := parseFragment(req.Header)
+		if !ok || id != "abc" || index != i || count != len(frags) {
+			t.Fatalf("fragment %d: parseFragment = %q, %d, %d, %v", i, id, index, count, ok)
+		}
+		piece, _ := io.ReadAll(req.Body)
+		head, full, err := r.add(now, sender, true, id, index, count, req, piece)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != nil {
+			if i != 0 {
+				t.Fatalf("message complete after fragment %d", i)
+			}
+			got = full
+		}
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("reassembled body differs (%d bytes, want %d)", len(got), len(body))
+	}
+	if r.pending() {
+		t.Error("reassembler still pending")
+	}
+
+	// A late duplicate shouldn't start a new message.
+	if head, _, _ := r.add(now, sender, true, "abc", 0, len(frags), nil, []byte("x")); head != nil || r.pending() {
+		t.Error("duplicate fragment was not ignored")
+	}
+}
+
+func TestSplitMessageTooSmall(t *testing.T) {
+	msg := []byte("POST /x HTTP/1.1\r\nHost: a\r\n\r\nbody")
+	if _, err := splitMessage(msg, "abc", 50); err == nil {
+		t.Error("expected error when headers don't fit")
+	}
+}
+
+func TestReassemblerPoll(t *testing.T) {
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	r := newReassembler(0, 4*time.Second)
+	start := time.Now()
+	r.add(start, sender, true, "abc", 1, 3, nil, []byte("b"))
+
+	if resends, expired := r.poll(start.Add(500 * time.Millisecond)); len(resends) != 0 || len(expired) != 0 {
+		t.Fatalf("poll too early = %v, %v", resends, expired)
+	}
+	resends, _ := r.poll(start.Add(time.Second))
+	if len(resends) != 1 || resends[0].id != "abc" || len(resends[0].missing) != 2 ||
+		resends[0].missing[0] != 0 || resends[0].missing[1] != 2 {
+		t.Fatalf("poll = %+v, want a resend of 0 and 2", resends)
+	}
+	if resends, _ := r.poll(start.Add(time.Second)); len(resends) != 0 {
+		t.Errorf("repeated poll = %+v, want nothing", resends)
+	}
+
+	r.add(start.Add(time.Second), sender, true, "abc", 0, 3, nil, []byte("a"))
+	resends, _ = r.poll(start.Add(3 * time.Second))
+	if len(resends) != 1 || len(resends[0].missing) != 1 || resends[0].missing[0] != 2 {
+		t.Fatalf("poll = %+v, want a resend of 2", resends)
+	}
+	if _, expired := r.poll(start.Add(5 * time.Second)); len(expired) != 1 {
+		t.Fatalf("poll expired = %v, want 1", expired)
+	}
+	if r.pending() {
+		t.Error("expired message still pending")
+	}
+}
+
+func TestReassemblerTooLarge(t *testing.T) {
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	r := newReassembler(600, 0)
+	now := time.Now()
+	if _, _, err := r.add(now, sender, true, "abc", 0, 2, nil, make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.add(now, sender, true, "abc", 1, 2, nil, make([]byte, 301)); err != ErrMessageTooLarge {
+		t.Errorf("add = %v, want ErrMessageTooLarge", err)
+	}
+	if r.pending() {
+		t.Error("oversized message still pending")
+	}
+}
+
+func TestReassemblerHugeCount(t *testing.T) {
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	r := newReassembler(0, 0)
+	now := time.Now()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, _, err := r.add(now, sender, true, "abc", 0, 1000000, nil, []byte("x")); err != ErrMessageTooLarge {
+		t.Errorf("add = %v, want ErrMessageTooLarge", err)
+	}
+	runtime.ReadMemStats(&after)
+	if r.pending() {
+		t.Error("message with a huge fragment count is pending")
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 64<<10 {
+		t.Errorf("rejecting a huge fragment count allocated %d bytes", n)
+	}
+
+	// The largest count that the size limit allows is still accepted.
+	if _, _, err := r.add(now, sender, true, "def", 0, defaultMaxMessageSize/minFragmentPayload, nil, []byte("x")); err != nil {
+		t.Errorf("add at the count limit = %v", err)
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	r := newReassembler(0, 0)
+	now := time.Now()
+	addr := func(i int) net.Addr { return &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 1} }
+	id := func(i int) string { return strconv.Itoa(i) }
+
+	for i := range maxPartialPerSender {
+		if _, _, err := r.add(now, addr(0), true, id(i), 0, 2, nil, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := r.add(now, addr(0), true, "more", 0, 2, nil, []byte("x")); err != ErrTooManyFragmented {
+		t.Errorf("add past the per-sender limit = %v, want ErrTooManyFragmented", err)
+	}
+	// Fragments of messages already pending are still accepted.
+	if _, full, err := r.add(now, addr(0), true, id(0), 1, 2, nil, []byte("y")); string(full) != "xy" || err != nil {
+		t.Errorf("completing a pending message = %q, %v", full, err)
+	}
+	if _, _, err := r.add(now, addr(0), true, "more", 0, 2, nil, []byte("x")); err != nil {
+		t.Errorf("add after completing one = %v", err)
+	}
+
+	for i := 1; len(r.partial) < maxPartialMessages; i++ {
+		if _, _, err := r.add(now, addr(i), true, "a", 0, 2, nil, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := r.add(now, addr(9999), true, "a", 0, 2, nil, []byte("x")); err != ErrTooManyFragmented {
+		t.Errorf("add past the total limit = %v, want ErrTooManyFragmented", err)
+	}
+	r.poll(now.Add(time.Hour))
+	if r.pending() || len(r.senders) != 0 {
+		t.Errorf("after expiry, %d pending from %d senders", len(r.partial), len(r.senders))
+	}
+}
+
+func TestReassemblerUntrusted(t *testing.T) {
+	r := newReassembler(0, 0)
+	now := time.Now()
+	addr := func(i int) net.Addr { return &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1} }
+
+	if _, _, err := r.add(now, addr(0), false, "a", 0, 2, nil, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.add(now, addr(0), false, "b", 0, 2, nil, []byte("x")); err != ErrTooManyFragmented {
+		t.Errorf("second untrusted message from a sender = %v, want ErrTooManyFragmented", err)
+	}
+	for i := 1; i < maxUntrustedPartials; i++ {
+		if _, _, err := r.add(now, addr(i), false, "a", 0, 2, nil, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := r.add(now, addr(100), false, "a", 0, 2, nil, []byte("x")); err != ErrTooManyFragmented {
+		t.Errorf("add past the untrusted limit = %v, want ErrTooManyFragmented", err)
+	}
+	// Trusted senders still have room.
+	if _, _, err := r.add(now, addr(101), true, "a", 0, 2, nil, []byte("x")); err != nil {
+		t.Errorf("trusted add = %v", err)
+	}
+	if _, full, _ := r.add(now, addr(0), false, "a", 1, 2, nil, []byte("y")); string(full) != "xy" || r.untrusted != maxUntrustedPartials-1 {
+		t.Errorf("completing an untrusted message = %q, %d untrusted pending", full, r.untrusted)
+	}
+}
+
+func TestResendLimiter(t *testing.T) {
+	udp := func(s string) *net.UDPAddr { a, _ := net.ResolveUDPAddr("udp", s); return a }
+	frags := [][]byte{make([]byte, 100), make([]byte, 100), make([]byte, 100)}
+	size := 300
+
+	l := newResendLimiter(udp("192.0.2.1:1900"), size)
+	if l.allow(udp("192.0.2.2:1900"), frags, []int{0}) {
+		t.Error("unicast: RESEND from another host answered")
+	}
+	if l.allow(udp("192.0.2.1:1234"), frags, []int{0}) {
+		t.Error("unicast: RESEND from another port answered")
+	}
+	if l.allow(udp("192.0.2.1:1900"), frags, []int{7}) {
+		t.Error("unicast: RESEND for no valid fragments answered")
+	}
+	for i := range maxResends {
+		if !l.allow(udp("192.0.2.1:1900"), frags, []int{0}) {
+			t.Fatalf("unicast: RESEND %d from the destination refused", i)
+		}
+	}
+	if l.allow(udp("192.0.2.1:1900"), frags, []int{0}) {
+		t.Error("unicast: RESEND past maxResends answered")
+	}
+
+	// Any host may ask about a multicast request, but only for so much in total.
+	l = newResendLimiter(udp("239.255.255.250:1900"), size)
+	sent := 0
+	for i := range 100 {
+		if l.allow(udp(fmt.Sprintf("192.0.2.%d:1900", i)), frags, []int{0, 1, 2}) {
+			sent += size
+		}
+	}
+	if sent != maxResends*size {
+		t.Errorf("multicast: resent %d bytes, want %d", sent, maxResends*size)
+	}
+}
@@ -0,0 +1,16 @@
+module github.com/dnesting/uhttp
+
+go 1.26.0
+
+require (
+	github.com/pion/dtls/v3 v3.1.10
+	golang.org/x/net v0.60.0
+)
+
+require (
+	github.com/pion/logging v0.2.4 // indirect
+	github.com/pion/transport/v5 v5.0.0 // indirect
+	golang.org/x/crypto v0.57.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+)
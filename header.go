@@ -0,0 +1,80 @@
+package uhttp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// HeaderField is a single header line, with its name exactly as it appears on the wire.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// OrderedHeader is a list of header fields that, unlike http.Header, preserves their order,
+// the case of their names, and any duplicates.  Some protocols (and some devices) care about
+// exactly what appears on the wire.
+type OrderedHeader []HeaderField
+
+// Add appends a field with the given name and value.
+func (h *OrderedHeader) Add(name, value string) {
+	*h = append(*h, HeaderField{name, value})
+}
+
+// Get returns the value of the first field whose name matches name, ignoring case, or "" if
+// there is none.
+func (h OrderedHeader) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields whose names match name, ignoring case.
+func (h OrderedHeader) Values(name string) []string {
+	var vals []string
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			vals = append(vals, f.Value)
+		}
+	}
+	return vals
+}
+
+// Has reports whether h contains a field whose name matches name, ignoring case.
+func (h OrderedHeader) Has(name string) bool {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Header returns the fields of h as an http.Header, with canonicalized names.
+func (h OrderedHeader) Header() http.Header {
+	hdr := make(http.Header, len(h))
+	for _, f := range h {
+		hdr.Add(f.Name, f.Value)
+	}
+	return hdr
+}
+
+type orderedHeaderKey struct{}
+
+// WithOrderedHeader returns a new context based on ctx that carries h.  A request made with the
+// returned context is written by Transport with exactly the fields in h, in order and with
+// their names unchanged, in place of those in its http.Request.Header.  Automatic headers are
+// still added ahead of them, unless h already contains them or the Transport omits them.
+func WithOrderedHeader(ctx context.Context, h OrderedHeader) context.Context {
+	return context.WithValue(ctx, orderedHeaderKey{}, h)
+}
+
+// ContextOrderedHeader returns the OrderedHeader associated with ctx, or nil if there is none.
+func ContextOrderedHeader(ctx context.Context) OrderedHeader {
+	h, _ := ctx.Value(orderedHeaderKey{}).(OrderedHeader)
+	return h
+}
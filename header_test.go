@@ -0,0 +1,87 @@
+package uhttp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOrderedHeader(t *testing.T) {
+	var h OrderedHeader
+	h.Add("ST", "a")
+	h.Add("Man", "b")
+	h.Add("st", "c")
+
+	if got := h.Get("St"); got != "a" {
+		t.Errorf("Get should return the first match ignoring case, got %q", got)
+	}
+	if got := strings.Join(h.Values("ST"), ","); got != "a,c" {
+		t.Errorf("Values should return all matches in order, got %q", got)
+	}
+	if !h.Has("MAN") || h.Has("NT") {
+		t.Errorf("Has should report MAN present and NT absent")
+	}
+	if got := h.Header()["St"]; len(got) != 2 {
+		t.Errorf("Header should canonicalize and merge duplicates, got %v", h.Header())
+	}
+}
+
+func TestWriteRequestOrderedHeader(t *testing.T) {
+	type testcase struct {
+		desc     string
+		tr       *Transport
+		fields   OrderedHeader
+		body     string
+		expected string
+	}
+
+	cases := []testcase{
+		{
+			"exact order, case and duplicates",
+			&Transport{HeaderCanon: strings.ToLower},
+			OrderedHeader{{"HOST", "239.255.255.250:1900"}, {"MAN", `"ssdp:discover"`}, {"ST", "a"}, {"st", "b"}, {"USER-AGENT", "x"}},
+			"",
+			"M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nST: a\r\nst: b\r\nUSER-AGENT: x\r\n\r\n",
+		},
+		{
+			"automatic headers first",
+			&Transport{OmitAutoHeaders: AutoUserAgent},
+			OrderedHeader{{"MAN", `"ssdp:discover"`}},
+			"abc",
+			"M-SEARCH * HTTP/1.1\r\nHost: 239.255.255.250:1900\r\nContent-Length: 3\r\nMAN: \"ssdp:discover\"\r\n\r\nabc",
+		},
+		{
+			"caller-provided content length",
+			&Transport{OmitAutoHeaders: AutoUserAgent | AutoHost},
+			OrderedHeader{{"content-length", "3"}},
+			"abc",
+			"M-SEARCH * HTTP/1.1\r\ncontent-length: 3\r\n\r\nabc",
+		},
+	}
+
+	for _, c := range cases {
+		ctx := WithOrderedHeader(context.Background(), c.fields)
+		req, _ := http.NewRequestWithContext(ctx, "M-SEARCH", "http://239.255.255.250:1900/", strings.NewReader(c.body))
+		req.URL.Path = "*"
+		req.Header.Set("Ignored", "yes")
+
+		var b bytes.Buffer
+		if err := c.tr.WriteRequest(&b, req); err != nil {
+			t.Errorf("%s: did not expect error, got %v", c.desc, err)
+			continue
+		}
+		if actual := b.String(); actual != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.desc, c.expected, actual)
+		}
+	}
+}
+
+func TestValidateOrderedHeader(t *testing.T) {
+	ctx := WithOrderedHeader(context.Background(), OrderedHeader{{"Bad Name", "x"}})
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://127.0.0.1:1900/", nil)
+	if err := validateRequest(req); err == nil {
+		t.Errorf("expected invalid ordered header name to be rejected")
+	}
+}
@@ -0,0 +1,58 @@
+package uhttp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ifaceReader reads a datagram along with the index of the interface it arrived on, or 0 if
+// that isn't known.
+type ifaceReader func(b []byte) (n, ifIndex int, addr net.Addr, err error)
+
+// reader returns an ifaceReader for responses arriving on conn, which reports the receiving
+// interface only if t.AcceptFrom needs it.
+func (t *Transport) reader(conn net.PacketConn) ifaceReader {
+	if t.AcceptFrom != nil && t.AcceptFrom.OnLink {
+		return newIfaceReader(conn)
+	}
+	return func(b []byte) (int, int, net.Addr, error) {
+		n, addr, err := conn.ReadFrom(b)
+		return n, 0, addr, err
+	}
+}
+
+// newIfaceReader returns an ifaceReader for conn.  The receiving interface is reported for UDP
+// sockets on platforms that provide it in control messages, and for shared sockets opened by
+// listenShared.
+func newIfaceReader(conn net.PacketConn) ifaceReader {
+	switch c := conn.(type) {
+	case *sharedConn:
+		return c.readFromIface
+	case *net.UDPConn:
+		// An IPv6 socket reports the interface of IPv4 packets too, where it accepts them.
+		if p := ipv6.NewPacketConn(c); p.SetControlMessage(ipv6.FlagInterface, true) == nil {
+			return func(b []byte) (int, int, net.Addr, error) {
+				n, cm, addr, err := p.ReadFrom(b)
+				if cm == nil {
+					return n, 0, addr, err
+				}
+				return n, cm.IfIndex, addr, err
+			}
+		}
+		if p := ipv4.NewPacketConn(c); p.SetControlMessage(ipv4.FlagInterface, true) == nil {
+			return func(b []byte) (int, int, net.Addr, error) {
+				n, cm, addr, err := p.ReadFrom(b)
+				if cm == nil {
+					return n, 0, addr, err
+				}
+				return n, cm.IfIndex, addr, err
+			}
+		}
+	}
+	return func(b []byte) (int, int, net.Addr, error) {
+		n, addr, err := conn.ReadFrom(b)
+		return n, 0, addr, err
+	}
+}
@@ -0,0 +1,46 @@
+package uhttp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIfaceReader(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface named lo: %v", err)
+	}
+	plain, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	shared, err := listenShared(freePort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+
+	for _, conn := range []net.PacketConn{plain, shared} {
+		read := newIfaceReader(conn)
+		c, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hi"))
+		c.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 10)
+		n, ifIndex, _, err := read(b)
+		if err != nil || string(b[:n]) != "hi" {
+			t.Fatalf("%T: read %q, %v", conn, b[:n], err)
+		}
+		if ifIndex == 0 {
+			t.Skipf("%T: receiving interface not reported on this platform", conn)
+		}
+		if ifIndex != lo.Index {
+			t.Errorf("%T: interface %d, want %d (lo)", conn, ifIndex, lo.Index)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package uhttp
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Quirk is a set of deviations from HTTP/1.1 that were found, and corrected, when parsing a
+// response with Transport.LenientParsing.
+type Quirk uint
+
+const (
+	// QuirkBareLF means lines ended with a bare LF rather than CRLF.
+	QuirkBareLF Quirk = 1 << iota
+
+	// QuirkNoReason means the status line had no reason phrase.  The standard one is used.
+	QuirkNoReason
+
+	// QuirkStatusGarbage means the status line had a malformed protocol version or status
+	// code, such as "HTTP/1.0 200OK", and was rewritten.
+	QuirkStatusGarbage
+
+	// QuirkDuplicateColon means a header name was followed by more than one colon.
+	QuirkDuplicateColon
+
+	// QuirkHeaderWhitespace means a header name had whitespace around it, before the colon.
+	QuirkHeaderWhitespace
+
+	// QuirkBadHeaderLine means a header line had no colon at all, and was dropped.
+	QuirkBadHeaderLine
+
+	// QuirkNoTerminator means the header section did not end with a blank line.
+	QuirkNoTerminator
+
+	// QuirkShortBody means Content-Length claimed more data than the packet held.  It is
+	// corrected to the length of the data present.
+	QuirkShortBody
+)
+
+var quirkNames = []string{
+	"bare-lf",
+	"no-reason",
+	"status-garbage",
+	"duplicate-colon",
+	"header-whitespace",
+	"bad-header-line",
+	"no-terminator",
+	"short-body",
+}
+
+// String returns the names of the quirks in q, separated by "|".
+func (q Quirk) String() string {
+	var names []string
+	for i, name := range quirkNames {
+		if q&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// normalizeResponse rewrites the response in data into a form http.ReadResponse will accept,
+// correcting the deviations described by Quirk.  Returns the quirks found; if there are none,
+// data is returned unchanged.
+func normalizeResponse(data []byte) ([]byte, Quirk) {
+	var quirks Quirk
+	var out bytes.Buffer
+
+	// nextLine returns the next line from data without its line ending, and whether a line
+	// ending was found at all.
+	nextLine := func() (string, bool) {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		data = rest
+		if found && !bytes.HasSuffix(line, []byte("\r")) {
+			quirks |= QuirkBareLF
+		}
+		return string(bytes.TrimSuffix(line, []byte("\r"))), found
+	}
+
+	status, _ := nextLine()
+	status, q := normalizeStatusLine(status)
+	quirks |= q
+	out.WriteString(status)
+	out.WriteString("\r\n")
+
+	var header OrderedHeader
+	terminated := false
+	for len(data) > 0 {
+		line, _ := nextLine()
+		if line == "" {
+			terminated = true
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if n := len(header); n > 0 {
+				header[n-1].Value += " " + strings.TrimSpace(line)
+				continue
+			}
+			quirks |= QuirkBadHeaderLine
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			quirks |= QuirkBadHeaderLine
+			continue
+		}
+		if trimmed := strings.TrimSpace(name); trimmed != name {
+			quirks |= QuirkHeaderWhitespace
+			name = trimmed
+		}
+		if trimmed := strings.TrimLeft(value, ":"); trimmed != value {
+			quirks |= QuirkDuplicateColon
+			value = trimmed
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	if !terminated {
+		quirks |= QuirkNoTerminator
+	}
+
+	body := data
+	for i, f := range header {
+		if !strings.EqualFold(f.Name, "Content-Length") {
+			continue
+		}
+		if n, err := strconv.Atoi(f.Value); err == nil && n > len(body) {
+			quirks |= QuirkShortBody
+			header[i].Value = strconv.Itoa(len(body))
+		}
+	}
+
+	if quirks == 0 {
+		return nil, 0
+	}
+	for _, f := range header {
+		out.Write(appendField(out.AvailableBuffer(), f.Name, f.Value))
+	}
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes(), quirks
+}
+
+// normalizeStatusLine rewrites a malformed status line into the form "HTTP/x.y NNN Reason".
+func normalizeStatusLine(line string) (string, Quirk) {
+	var quirks Quirk
+	proto, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if _, _, ok := http.ParseHTTPVersion(proto); !ok {
+		quirks |= QuirkStatusGarbage
+		if _, _, ok := http.ParseHTTPVersion(strings.ToUpper(proto)); ok {
+			proto = strings.ToUpper(proto)
+		} else {
+			proto = "HTTP/1.1"
+		}
+	}
+
+	rest = strings.TrimLeft(rest, " ")
+	digits := 0
+	for digits < len(rest) && digits < 3 && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	code, reason := rest[:digits], rest[digits:]
+	if digits != 3 {
+		// Nothing more we can do; leave it for http.ReadResponse to reject, but still report
+		// what was found.
+		if quirks == 0 {
+			return line, 0
+		}
+		return proto + " " + rest, quirks
+	}
+	switch {
+	case reason == "":
+		quirks |= QuirkNoReason
+	case reason[0] != ' ':
+		quirks |= QuirkStatusGarbage
+		reason = ""
+	default:
+		reason = strings.TrimSpace(reason)
+		if reason == "" {
+			quirks |= QuirkNoReason
+		}
+	}
+	if quirks == 0 {
+		return line, 0
+	}
+	if reason == "" {
+		n, _ := strconv.Atoi(code)
+		reason = http.StatusText(n)
+	}
+	return proto + " " + code + " " + reason, quirks
+}
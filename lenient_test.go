@@ -0,0 +1,105 @@
+package uhttp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestLenientParsing(t *testing.T) {
+	type testcase struct {
+		desc   string
+		data   string
+		quirks Quirk
+		status string
+		header string
+		body   string
+	}
+
+	cases := []testcase{
+		{"conforming", "HTTP/1.1 200 OK\r\nST: x\r\nContent-Length: 2\r\n\r\nhi", 0, "200 OK", "x", "hi"},
+		{"bare lf", "HTTP/1.1 200 OK\nST: x\n\n", QuirkBareLF, "200 OK", "x", ""},
+		{"no reason", "HTTP/1.1 200\r\nST: x\r\n\r\n", QuirkNoReason, "200 OK", "x", ""},
+		{"status garbage", "HTTP/1.0 200OK\r\nST: x\r\n\r\n", QuirkStatusGarbage, "200 OK", "x", ""},
+		{"lower-case proto", "http/1.0 404 Nope\r\nST: x\r\n\r\n", QuirkStatusGarbage, "404 Nope", "x", ""},
+		{"duplicate colon", "HTTP/1.1 200 OK\r\nST:: x\r\n\r\n", QuirkDuplicateColon, "200 OK", "x", ""},
+		{"header whitespace", "HTTP/1.1 200 OK\r\nST : x\r\n\r\n", QuirkHeaderWhitespace, "200 OK", "x", ""},
+		{"bad header line", "HTTP/1.1 200 OK\r\nbogus\r\nST: x\r\n\r\n", QuirkBadHeaderLine, "200 OK", "x", ""},
+		{"no terminator", "HTTP/1.1 200 OK\r\nST: x\r\n", QuirkNoTerminator, "200 OK", "x", ""},
+		{"short body", "HTTP/1.1 200 OK\r\nST: x\r\nContent-Length: 10\r\n\r\nhi", QuirkShortBody, "200 OK", "x", "hi"},
+		{"several", "HTTP/1.1 200\nST:: x\n", QuirkBareLF | QuirkNoReason | QuirkDuplicateColon | QuirkNoTerminator, "200 OK", "x", ""},
+	}
+
+	sender := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1900}
+	req, _ := http.NewRequest("GET", "http://10.0.0.1:1900/", nil)
+	for _, c := range cases {
+		tr := &Transport{LenientParsing: true}
+		res, err := tr.parseResponse(sender, []byte(c.data), req)
+		if err != nil {
+			t.Errorf("%s: did not expect error, got %v", c.desc, err)
+			continue
+		}
+		info := ResponseInfoFor(res)
+		if info.Quirks != c.quirks {
+			t.Errorf("%s: expected quirks %v, got %v", c.desc, c.quirks, info.Quirks)
+		}
+		if res.Status != c.status {
+			t.Errorf("%s: expected status %q, got %q", c.desc, c.status, res.Status)
+		}
+		if got := res.Header.Get("ST"); got != c.header {
+			t.Errorf("%s: expected ST %q, got %q", c.desc, c.header, got)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil || string(body) != c.body {
+			t.Errorf("%s: expected body %q, got %q (%v)", c.desc, c.body, body, err)
+		}
+		if info.StatusLine == "" || info.Sender != sender {
+			t.Errorf("%s: expected raw info to be recorded, got %+v", c.desc, info)
+		}
+	}
+}
+
+func TestStrictParsing(t *testing.T) {
+	tr := &Transport{}
+	req, _ := http.NewRequest("GET", "http://10.0.0.1:1900/", nil)
+	for _, data := range []string{
+		"HTTP/1.0 200OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nbogus\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nST: x\r\n",
+	} {
+		if _, err := tr.parseResponse(nil, []byte(data), req); err == nil {
+			t.Errorf("expected %q to be rejected without LenientParsing", data)
+		}
+	}
+}
+
+func TestLenientParsingUnrecoverable(t *testing.T) {
+	tr := &Transport{LenientParsing: true}
+	req, _ := http.NewRequest("GET", "http://10.0.0.1:1900/", nil)
+	if _, err := tr.parseResponse(nil, []byte("garbage"), req); err == nil {
+		t.Errorf("expected an error for a packet that is not a response")
+	}
+}
+
+func TestQuirkString(t *testing.T) {
+	if got := (QuirkBareLF | QuirkShortBody).String(); got != "bare-lf|short-body" {
+		t.Errorf("expected %q, got %q", "bare-lf|short-body", got)
+	}
+	if got := Quirk(0).String(); got != "none" {
+		t.Errorf("expected %q, got %q", "none", got)
+	}
+}
+
+func TestNormalizeStatusLineBadCode(t *testing.T) {
+	line, quirks := normalizeStatusLine("http/1.1 2x OK")
+	if quirks != QuirkStatusGarbage {
+		t.Errorf("quirks = %v, want %v", quirks, QuirkStatusGarbage)
+	}
+	if line != "HTTP/1.1 2x OK" {
+		t.Errorf("line = %q, want the protocol corrected", line)
+	}
+	if line, quirks := normalizeStatusLine("HTTP/1.1 2x OK"); quirks != 0 || line != "HTTP/1.1 2x OK" {
+		t.Errorf("got %q, %v; want the line unchanged", line, quirks)
+	}
+}
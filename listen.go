@@ -0,0 +1,236 @@
+package uhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// packetConn returns c as a net.PacketConn.  If c is not one already, its ReadFrom reports
+// every datagram as coming from c's remote address, and its WriteTo writes only to that
+// address.
+func packetConn(c net.Conn) net.PacketConn {
+	if pc, ok := c.(net.PacketConn); ok {
+		return pc
+	}
+	return connPacketConn{c}
+}
+
+// connPacketConn adapts a connected datagram-oriented net.Conn, such as a DTLS connection, to
+// net.PacketConn.
+type connPacketConn struct {
+	net.Conn
+}
+
+func (c connPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c connPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr != nil && addr.String() != c.RemoteAddr().String() {
+		return 0, fmt.Errorf("uhttp: write to %v on connection to %v", addr, c.RemoteAddr())
+	}
+	return c.Write(b)
+}
+
+// sharedQueueLen is the number of packets that may be queued for each user of a shared socket
+// before further packets to it are dropped.
+const sharedQueueLen = 64
+
+// errSharedDeadline is returned by the deadline methods of a shared socket.
+var errSharedDeadline = errors.New("uhttp: deadlines are not supported on shared sockets")
+
+// listenReuse opens a UDP socket on addr with SO_REUSEADDR and, where available, SO_REUSEPORT
+// set, so that other processes on the host (such as another SSDP agent) may bind the same
+// port.
+func listenReuse(ctx context.Context, addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) { serr = setReuse(fd) }); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.ListenPacket(ctx, "udp", addr)
+}
+
+// sharedListener is a socket bound to a fixed local address, shared by every request in the
+// process that uses that address.  Each packet received is delivered to all current users.
+type sharedListener struct {
+	key  string
+	conn net.PacketConn
+	refs int
+	subs map[*sharedConn]struct{}
+}
+
+// listeners holds the sharedListeners currently open, by local address.
+var listeners struct {
+	sync.Mutex
+	m map[string]*sharedListener
+}
+
+// sharedKey returns the canonical form of the local address addr, so that equivalent spellings
+// of it share a socket.  Opening two sockets on the same port would leave the system to spread
+// unicast replies between them, and lose those that went to the wrong one.  Any unspecified
+// address, such as ":1900", "0.0.0.0:1900" or "[::]:1900", becomes the wildcard ":1900".
+func sharedKey(addr string) (string, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return "", err
+	}
+	if a.IP == nil || a.IP.IsUnspecified() {
+		return ":" + strconv.Itoa(a.Port), nil
+	}
+	return a.String(), nil
+}
+
+// listenShared returns a socket bound to addr, sharing one with any other users of addr in this
+// process.  Closing the returned conn releases this use of it; the socket itself is closed once
+// all of its users have done so.
+func listenShared(addr string) (net.PacketConn, error) {
+	key, err := sharedKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners.Lock()
+	defer listeners.Unlock()
+	l := listeners.m[key]
+	if l == nil {
+		conn, err := listenReuse(context.Background(), key)
+		if err != nil {
+			return nil, err
+		}
+		l = &sharedListener{key: key, conn: conn, subs: make(map[*sharedConn]struct{})}
+		if listeners.m == nil {
+			listeners.m = make(map[string]*sharedListener)
+		}
+		listeners.m[key] = l
+		go l.read(newIfaceReader(conn))
+	}
+	l.refs++
+	c := &sharedConn{l: l, ch: make(chan sharedPacket, sharedQueueLen), closed: make(chan struct{})}
+	l.subs[c] = struct{}{}
+	return c, nil
+}
+
+// read delivers each packet received by read, which reads from l's socket, to every user of
+// l, until the socket is closed.
+func (l *sharedListener) read(read ifaceReader) {
+	b := make([]byte, maxPacketSize+1)
+	for {
+		n, ifIndex, addr, err := read(b)
+		if err != nil {
+			listeners.Lock()
+			// Nobody new should get this socket, but its users must still release it.
+			l.unregister()
+			for c := range l.subs {
+				c.fail(err)
+			}
+			listeners.Unlock()
+			return
+		}
+		p := sharedPacket{addr: addr, ifIndex: ifIndex, data: append([]byte(nil), b[:n]...)}
+		listeners.Lock()
+		for c := range l.subs {
+			select {
+			case c.ch <- p:
+			default:
+				// This user isn't keeping up; don't let it hold up the others.
+			}
+		}
+		listeners.Unlock()
+	}
+}
+
+// release removes c from l, closing the socket if c was its last user.  listeners must be
+// locked.
+func (l *sharedListener) release(c *sharedConn) error {
+	delete(l.subs, c)
+	if l.refs--; l.refs > 0 {
+		return nil
+	}
+	l.unregister()
+	return l.conn.Close()
+}
+
+// unregister removes l from listeners.  listeners must be locked.
+func (l *sharedListener) unregister() {
+	if listeners.m[l.key] == l {
+		delete(listeners.m, l.key)
+	}
+}
+
+type sharedPacket struct {
+	addr    net.Addr
+	ifIndex int // of the receiving interface, or 0 if unknown
+	data    []byte
+}
+
+// sharedConn is one user's view of a sharedListener.
+type sharedConn struct {
+	l      *sharedListener
+	ch     chan sharedPacket
+	once   sync.Once
+	closed chan struct{}
+	err    error // set before closed is closed
+}
+
+// fail ends c with err, for when the underlying socket can no longer be read.
+func (c *sharedConn) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.closed)
+	})
+}
+
+func (c *sharedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, addr, err := c.readFromIface(b)
+	return n, addr, err
+}
+
+// readFromIface is ReadFrom, but also reports the index of the interface the packet arrived
+// on, or 0 if it isn't known.
+func (c *sharedConn) readFromIface(b []byte) (int, int, net.Addr, error) {
+	select {
+	case p := <-c.ch:
+		return copy(b, p.data), p.ifIndex, p.addr, nil
+	case <-c.closed:
+		return 0, 0, nil, c.err
+	}
+}
+
+func (c *sharedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.err
+	default:
+		return c.l.conn.WriteTo(b, addr)
+	}
+}
+
+// Close releases c's use of the shared socket.
+func (c *sharedConn) Close() error {
+	c.fail(fmt.Errorf("uhttp: read shared socket: %w", net.ErrClosed))
+	listeners.Lock()
+	defer listeners.Unlock()
+	if _, ok := c.l.subs[c]; !ok {
+		return nil
+	}
+	return c.l.release(c)
+}
+
+func (c *sharedConn) LocalAddr() net.Addr {
+	return c.l.conn.LocalAddr()
+}
+
+func (c *sharedConn) SetDeadline(time.Time) error      { return errSharedDeadline }
+func (c *sharedConn) SetReadDeadline(time.Time) error  { return errSharedDeadline }
+func (c *sharedConn) SetWriteDeadline(time.Time) error { return errSharedDeadline }
@@ -0,0 +1,127 @@
+package uhttp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback address with a UDP port that is not currently in use.
+func freePort(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+func TestListenReuse(t *testing.T) {
+	addr := freePort(t)
+	a, err := listenReuse(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := listenReuse(context.Background(), addr)
+	if err != nil {
+		t.Skipf("port sharing not supported here: %v", err)
+	}
+	b.Close()
+}
+
+func TestListenShared(t *testing.T) {
+	addr := freePort(t)
+	a, err := listenShared(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := listenShared(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners.Lock()
+	l := listeners.m[addr]
+	listeners.Unlock()
+	if l == nil || l.refs != 2 || a.(*sharedConn).l != l || b.(*sharedConn).l != l {
+		t.Fatalf("sockets not shared: %+v", l)
+	}
+
+	send := func(msg string) {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte(msg))
+	}
+	recv := func(c net.PacketConn) string {
+		buf := make([]byte, 100)
+		done := make(chan string)
+		go func() {
+			n, _, _ := c.ReadFrom(buf)
+			done <- string(buf[:n])
+		}()
+		select {
+		case s := <-done:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout reading shared socket")
+			return ""
+		}
+	}
+
+	send("one")
+	if got := recv(a); got != "one" {
+		t.Errorf("a got %q", got)
+	}
+	if got := recv(b); got != "one" {
+		t.Errorf("b got %q", got)
+	}
+
+	a.Close()
+	if _, _, err := a.ReadFrom(make([]byte, 10)); err == nil {
+		t.Error("read after Close succeeded")
+	}
+	send("two")
+	if got := recv(b); got != "two" {
+		t.Errorf("b got %q after a closed", got)
+	}
+
+	b.Close()
+	listeners.Lock()
+	defer listeners.Unlock()
+	if listeners.m[addr] != nil {
+		t.Error("listener still registered after all users closed")
+	}
+}
+
+func TestListenSharedKey(t *testing.T) {
+	port := freePort(t)
+	_, p, _ := net.SplitHostPort(port)
+	a, err := listenShared(":" + p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for _, addr := range []string{"0.0.0.0:" + p, "[::]:" + p} {
+		b, err := listenShared(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.(*sharedConn).l != a.(*sharedConn).l {
+			t.Errorf("%s opened a second socket for :%s", addr, p)
+		}
+		b.Close()
+	}
+
+	c, err := listenShared("localhost:" + p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.(*sharedConn).l.key != "127.0.0.1:"+p {
+		t.Errorf("key = %q, want the resolved address", c.(*sharedConn).l.key)
+	}
+}
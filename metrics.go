@@ -0,0 +1,130 @@
+package uhttp
+
+import (
+	"sort"
+	"sync"
+)
+
+// Metrics receives counters and histogram observations from a Transport or Server.  Names are those of
+// the Metric constants.  Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Add increments the counter name by delta.
+	Add(name string, delta int64)
+
+	// Observe records v in the histogram name.
+	Observe(name string, v float64)
+}
+
+// Names of the metrics reported to Metrics.
+const (
+	MetricRequestsSent         = "uhttp_requests_sent_total"         // counter
+	MetricRepeatsSent          = "uhttp_repeats_sent_total"          // counter
+	MetricBytesSent            = "uhttp_sent_bytes_total"            // counter
+	MetricPacketsReceived      = "uhttp_packets_received_total"      // counter
+	MetricBytesReceived        = "uhttp_received_bytes_total"        // counter
+	MetricParseFailures        = "uhttp_parse_failures_total"        // counter
+	MetricDropped              = "uhttp_dropped_packets_total"       // counter
+	MetricRejected             = "uhttp_rejected_packets_total"      // counter
+	MetricTruncated            = "uhttp_truncated_responses_total"   // counter
+	MetricOversizeRequests     = "uhttp_oversize_requests_total"     // counter
+	MetricOversizeResponses    = "uhttp_oversize_responses_total"    // counter
+	MetricResponsesSent        = "uhttp_responses_sent_total"        // counter
+	MetricSignatureFailures    = "uhttp_signature_failures_total"    // counter
+	MetricRateLimited          = "uhttp_rate_limited_total"          // counter
+	MetricRefusedSources       = "uhttp_refused_sources_total"       // counter
+	MetricAmplificationLimited = "uhttp_amplification_limited_total" // counter
+	MetricResponseLatency      = "uhttp_response_latency_seconds"    // histogram
+	MetricResponses            = "uhttp_responses_per_request"       // histogram
+)
+
+// DefaultBuckets are the histogram bucket upper bounds used by MemoryMetrics for latencies, in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var defaultBuckets = map[string][]float64{
+	MetricResponses: {0, 1, 2, 5, 10, 20, 50, 100, 200},
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Add(string, int64)       {}
+func (nopMetrics) Observe(string, float64) {}
+
+// MemoryMetrics is a Metrics that keeps its values in memory, and can report them with
+// Snapshot.  The zero value is ready to use.
+type MemoryMetrics struct {
+	// Buckets gives the upper bounds of the histogram buckets to use for each metric name.
+	// Histograms not listed here use sensible defaults, which is DefaultBuckets for most.
+	Buckets map[string][]float64
+
+	mu       sync.Mutex
+	counters map[string]int64
+	hists    map[string]*HistogramSnapshot
+}
+
+// HistogramSnapshot is the state of a histogram at the time of a snapshot.
+type HistogramSnapshot struct {
+	Count  uint64
+	Sum    float64
+	Bounds []float64 // upper bounds of each bucket, excluding +Inf
+	Counts []uint64  // observations in each bucket (not cumulative), with the last for +Inf
+}
+
+// MetricsSnapshot is a copy of the values held by a MemoryMetrics.
+type MetricsSnapshot struct {
+	Counters   map[string]int64
+	Histograms map[string]HistogramSnapshot
+}
+
+// Add increments the counter name by delta.
+func (m *MemoryMetrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]int64)
+	}
+	m.counters[name] += delta
+}
+
+// Observe records v in the histogram name.
+func (m *MemoryMetrics) Observe(name string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hists == nil {
+		m.hists = make(map[string]*HistogramSnapshot)
+	}
+	h := m.hists[name]
+	if h == nil {
+		bounds := m.Buckets[name]
+		if bounds == nil {
+			bounds = defaultBuckets[name]
+		}
+		if bounds == nil {
+			bounds = DefaultBuckets
+		}
+		h = &HistogramSnapshot{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+		m.hists[name] = h
+	}
+	h.Count++
+	h.Sum += v
+	h.Counts[sort.SearchFloat64s(h.Bounds, v)]++
+}
+
+// Snapshot returns a copy of the current values.
+func (m *MemoryMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Counters:   make(map[string]int64, len(m.counters)),
+		Histograms: make(map[string]HistogramSnapshot, len(m.hists)),
+	}
+	for k, v := range m.counters {
+		s.Counters[k] = v
+	}
+	for k, h := range m.hists {
+		c := *h
+		c.Counts = append([]uint64(nil), h.Counts...)
+		s.Histograms[k] = c
+	}
+	return s
+}
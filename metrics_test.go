@@ -0,0 +1,62 @@
+package uhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMemoryMetrics(t *testing.T) {
+	m := &MemoryMetrics{Buckets: map[string][]float64{"h": {1, 2}}}
+	m.Add("c", 2)
+	m.Add("c", 3)
+	for _, v := range []float64{0.5, 1, 1.5, 7} {
+		m.Observe("h", v)
+	}
+
+	s := m.Snapshot()
+	if s.Counters["c"] != 5 {
+		t.Errorf("expected counter c to be 5, got %d", s.Counters["c"])
+	}
+	h := s.Histograms["h"]
+	if h.Count != 4 || h.Sum != 10 {
+		t.Errorf("expected count 4 and sum 10, got %d and %v", h.Count, h.Sum)
+	}
+	if got := len(h.Counts); got != 3 || h.Counts[0] != 2 || h.Counts[1] != 1 || h.Counts[2] != 1 {
+		t.Errorf("expected bucket counts [2 1 1], got %v", h.Counts)
+	}
+
+	// The snapshot should not change as more values are recorded.
+	m.Observe("h", 0)
+	if h.Counts[0] != 2 {
+		t.Errorf("snapshot should be a copy, got bucket counts %v", h.Counts)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	m := &MemoryMetrics{}
+	m.Add(MetricRequestsSent, 3)
+	m.Observe(MetricResponses, 2)
+	m.Observe(MetricResponses, 4)
+
+	rec := httptest.NewRecorder()
+	PrometheusHandler(m).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE uhttp_requests_sent_total counter\nuhttp_requests_sent_total 3\n",
+		"# TYPE uhttp_responses_per_request histogram\n",
+		`uhttp_responses_per_request_bucket{le="1"} 0` + "\n",
+		`uhttp_responses_per_request_bucket{le="2"} 1` + "\n",
+		`uhttp_responses_per_request_bucket{le="5"} 2` + "\n",
+		`uhttp_responses_per_request_bucket{le="+Inf"} 2` + "\n",
+		"uhttp_responses_per_request_sum 6\nuhttp_responses_per_request_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package uhttp
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Middleware wraps a RoundTripMultier to add behavior such as logging, metrics, request
+// stamping or response filtering.  Middleware must not modify the request it is given; it
+// should clone it first, as with http.RoundTripper.
+type Middleware func(next RoundTripMultier) RoundTripMultier
+
+// Chain wraps rt with each of mw.  The first Middleware is the outermost, so it sees each
+// request first and each response last.
+func Chain(rt RoundTripMultier, mw ...Middleware) RoundTripMultier {
+	for i := len(mw) - 1; i >= 0; i-- {
+		rt = mw[i](rt)
+	}
+	return rt
+}
+
+// RoundTripMultiFunc adapts an ordinary function to the RoundTripMultier interface.  Its
+// RoundTrip method returns the first response received.
+type RoundTripMultiFunc func(req *http.Request, wait time.Duration, fn func(sender net.Addr, res *http.Response) error) error
+
+// RoundTripMulti calls f(req, wait, fn).
+func (f RoundTripMultiFunc) RoundTripMulti(req *http.Request, wait time.Duration, fn func(sender net.Addr, res *http.Response) error) error {
+	return f(req, wait, fn)
+}
+
+// RoundTrip calls f and waits for a single response.
+func (f RoundTripMultiFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return roundTripFirst(f, req)
+}
+
+// roundTripFirst issues req via rt and returns the first response received, or ErrTimeout if
+// none arrive.
+func roundTripFirst(rt RoundTripMultier, req *http.Request) (res *http.Response, err error) {
+	err = rt.RoundTripMulti(req, 0, func(_ net.Addr, r *http.Response) error {
+		res = r
+		return Stop
+	})
+	if res == nil && err == nil {
+		err = ErrTimeout
+	}
+	return
+}
+
+// ModifyRequest returns a Middleware that calls fn with a clone of each request before passing
+// it on.
+func ModifyRequest(fn func(req *http.Request)) Middleware {
+	return func(next RoundTripMultier) RoundTripMultier {
+		return RoundTripMultiFunc(func(req *http.Request, wait time.Duration, f func(net.Addr, *http.Response) error) error {
+			req = req.Clone(req.Context())
+			fn(req)
+			return next.RoundTripMulti(req, wait, f)
+		})
+	}
+}
+
+// DefaultHeaders returns a Middleware that adds each header in h to requests that do not
+// already have a value for it, such as a USER-AGENT or CPFN.UPNP.ORG that every request should
+// carry.
+func DefaultHeaders(h http.Header) Middleware {
+	return ModifyRequest(func(req *http.Request) {
+		for k, vals := range h {
+			if _, ok := req.Header[k]; !ok {
+				req.Header[k] = append([]string(nil), vals...)
+			}
+		}
+	})
+}
+
+// FilterResponses returns a Middleware that only delivers responses for which keep returns
+// true.  Other responses are discarded.
+func FilterResponses(keep func(sender net.Addr, res *http.Response) bool) Middleware {
+	return func(next RoundTripMultier) RoundTripMultier {
+		return RoundTripMultiFunc(func(req *http.Request, wait time.Duration, fn func(net.Addr, *http.Response) error) error {
+			return next.RoundTripMulti(req, wait, func(sender net.Addr, res *http.Response) error {
+				if !keep(sender, res) {
+					return nil
+				}
+				return fn(sender, res)
+			})
+		})
+	}
+}
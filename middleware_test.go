@@ -0,0 +1,99 @@
+package uhttp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMulti returns a RoundTripMultier that records each request it sees and responds with
+// one response per status code given.
+func fakeMulti(seen *[]*http.Request, codes ...int) RoundTripMultier {
+	return RoundTripMultiFunc(func(req *http.Request, _ time.Duration, fn func(net.Addr, *http.Response) error) error {
+		*seen = append(*seen, req)
+		for i, code := range codes {
+			sender := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1900}
+			if err := fn(sender, &http.Response{StatusCode: code, Request: req}); err != nil {
+				if err == Stop {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return ModifyRequest(func(req *http.Request) {
+			order = append(order, name)
+			req.Header.Add("X-Layer", name)
+		})
+	}
+
+	var seen []*http.Request
+	rt := Chain(fakeMulti(&seen, 200), tag("a"), tag("b"), DefaultHeaders(http.Header{
+		"User-Agent": {"uhttp-test"},
+		"X-Layer":    {"default"},
+	}))
+
+	req, _ := http.NewRequest("M-SEARCH", "http://239.255.255.250:1900/", nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("expected a 200 response, got %v, %v", res, err)
+	}
+
+	if got := strings.Join(order, ","); got != "a,b" {
+		t.Errorf("expected layers to run in order a,b, got %s", got)
+	}
+	if len(seen) != 1 {
+		t.Fatalf("expected 1 request to reach the transport, got %d", len(seen))
+	}
+	if got := strings.Join(seen[0].Header["X-Layer"], ","); got != "a,b" {
+		t.Errorf("expected X-Layer a,b (not overridden by default), got %s", got)
+	}
+	if got := seen[0].Header.Get("User-Agent"); got != "uhttp-test" {
+		t.Errorf("expected default User-Agent to be added, got %q", got)
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("original request should not be modified, got headers %v", req.Header)
+	}
+}
+
+func TestFilterResponses(t *testing.T) {
+	var seen []*http.Request
+	rt := Chain(fakeMulti(&seen, 404, 200, 500, 200), FilterResponses(func(_ net.Addr, res *http.Response) bool {
+		return res.StatusCode == 200
+	}))
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+	var senders []string
+	err := rt.RoundTripMulti(req, 0, func(sender net.Addr, res *http.Response) error {
+		senders = append(senders, sender.String())
+		return nil
+	})
+	if err != nil {
+		t.Errorf("did not expect error, got %v", err)
+	}
+	if got := strings.Join(senders, ","); got != "10.0.0.2:1900,10.0.0.4:1900" {
+		t.Errorf("expected only 200 responses to be delivered, got %s", got)
+	}
+
+	// RoundTrip should ignore the filtered responses and return the first that passes.
+	res, err := rt.RoundTrip(req)
+	if err != nil || res.StatusCode != 200 {
+		t.Errorf("expected a 200 response, got %v, %v", res, err)
+	}
+}
+
+func TestRoundTripMultiFuncTimeout(t *testing.T) {
+	var seen []*http.Request
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+	if _, err := fakeMulti(&seen).RoundTrip(req); err != ErrTimeout {
+		t.Errorf("expected ErrTimeout with no responses, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package uhttp
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RequestMatcher reports whether a request should be routed to a handler registered with a
+// ServeMux.
+type RequestMatcher func(req *http.Request) bool
+
+// MatchHeader returns a RequestMatcher for requests with a header name equal to value.
+// Values are compared without regard to case or surrounding double quotes, since SSDP sends
+// MAN as "ssdp:discover" with the quotes.  An empty value matches any request with the header
+// present.
+func MatchHeader(name, value string) RequestMatcher {
+	value = unquote(value)
+	return func(req *http.Request) bool {
+		vals, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok || value == "" {
+			return ok
+		}
+		for _, v := range vals {
+			if strings.EqualFold(unquote(v), value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchTarget returns a RequestMatcher for requests with the given request target, such as "*"
+// for SSDP.
+func MatchTarget(target string) RequestMatcher {
+	return func(req *http.Request) bool {
+		if req.RequestURI != "" {
+			return req.RequestURI == target
+		}
+		return req.URL != nil && req.URL.RequestURI() == target
+	}
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+// ServeMux is an http.Handler that dispatches requests by method and header, as HTTPU
+// protocols route on these rather than on path.  For example, an SSDP device might handle
+// M-SEARCH requests with MAN: "ssdp:discover", and a control point NOTIFY requests with
+// NTS: ssdp:alive:
+//
+//	mux := &uhttp.ServeMux{}
+//	mux.HandleFunc("M-SEARCH", search, uhttp.MatchHeader("MAN", "ssdp:discover"))
+//	mux.HandleFunc("NOTIFY", alive, uhttp.MatchHeader("NTS", "ssdp:alive"))
+//	server := &uhttp.Server{Addr: "239.255.255.250:1900", Handler: mux}
+//
+// Each request is passed to the first handler registered whose method and matchers all match
+// it, and otherwise to Fallback.  The zero value is ready to use.  Handlers may be registered
+// concurrently with requests being served.
+type ServeMux struct {
+	// Fallback handles requests that match no registered handler.  A nil value ignores them,
+	// which with Server means that no response is sent.
+	Fallback http.Handler
+
+	mu     sync.RWMutex
+	routes []muxRoute
+}
+
+type muxRoute struct {
+	method  string
+	match   []RequestMatcher
+	handler http.Handler
+}
+
+// Handle registers h for requests with the given method, case-sensitively, that satisfy all of
+// match.  An empty method matches any.
+func (mux *ServeMux) Handle(method string, h http.Handler, match ...RequestMatcher) {
+	if h == nil {
+		panic("uhttp: nil handler")
+	}
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.routes = append(mux.routes, muxRoute{method, match, h})
+}
+
+// HandleFunc registers f for requests with the given method that satisfy all of match.
+func (mux *ServeMux) HandleFunc(method string, f func(http.ResponseWriter, *http.Request), match ...RequestMatcher) {
+	if f == nil {
+		panic("uhttp: nil handler")
+	}
+	mux.Handle(method, http.HandlerFunc(f), match...)
+}
+
+// Handler returns the handler that would serve req, or nil if there is none.
+func (mux *ServeMux) Handler(req *http.Request) http.Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	for _, r := range mux.routes {
+		if r.matches(req) {
+			return r.handler
+		}
+	}
+	return mux.Fallback
+}
+
+func (r *muxRoute) matches(req *http.Request) bool {
+	if r.method != "" && r.method != req.Method {
+		return false
+	}
+	for _, m := range r.match {
+		if !m(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP dispatches req to the handler that matches it.
+func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h := mux.Handler(req); h != nil {
+		h.ServeHTTP(w, req)
+	}
+}
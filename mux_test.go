@@ -0,0 +1,96 @@
+package uhttp_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnesting/uhttp"
+)
+
+func readRequest(t *testing.T, s string) *http.Request {
+	t.Helper()
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestServeMux(t *testing.T) {
+	tag := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+	}
+	mux := &uhttp.ServeMux{}
+	mux.Handle("M-SEARCH", tag("discover"), uhttp.MatchHeader("MAN", "ssdp:discover"), uhttp.MatchTarget("*"))
+	mux.Handle("NOTIFY", tag("alive"), uhttp.MatchHeader("NTS", "ssdp:alive"))
+	mux.Handle("NOTIFY", tag("byebye"), uhttp.MatchHeader("NTS", "ssdp:byebye"))
+	mux.Handle("NOTIFY", tag("notify"))
+	mux.Handle("", tag("any-st"), uhttp.MatchHeader("ST", ""))
+
+	for _, tc := range []struct {
+		req  string
+		want string
+	}{
+		{"M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nST: ssdp:all\r\n\r\n", "discover"},
+		{"M-SEARCH * HTTP/1.1\r\nMAN: \"SSDP:Discover\"\r\n\r\n", "discover"},
+		{"M-SEARCH /x HTTP/1.1\r\nMAN: \"ssdp:discover\"\r\nST: ssdp:all\r\n\r\n", "any-st"},
+		{"NOTIFY * HTTP/1.1\r\nNTS: ssdp:alive\r\n\r\n", "alive"},
+		{"NOTIFY * HTTP/1.1\r\nNTS: ssdp:byebye\r\n\r\n", "byebye"},
+		{"NOTIFY * HTTP/1.1\r\nNTS: ssdp:update\r\n\r\n", "notify"},
+		{"SUBSCRIBE * HTTP/1.1\r\nST: x\r\n\r\n", "any-st"},
+		{"M-SEARCH * HTTP/1.1\r\nMAN: \"ssdp:other\"\r\n\r\n", ""},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, readRequest(t, tc.req))
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("%q: handled by %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	mux.Fallback = tag("fallback")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, readRequest(t, "GET / HTTP/1.1\r\n\r\n"))
+	if got := w.Body.String(); got != "fallback" {
+		t.Errorf("unmatched request handled by %q, want fallback", got)
+	}
+}
+
+func TestServeMuxServer(t *testing.T) {
+	mux := &uhttp.ServeMux{}
+	mux.HandleFunc("M-SEARCH", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("St", r.Header.Get("St"))
+		w.WriteHeader(http.StatusOK)
+	}, uhttp.MatchHeader("MAN", "ssdp:discover"))
+	addr := serve(t, &uhttp.Server{Handler: mux}, nil)
+
+	tr := &uhttp.Transport{}
+	for _, tc := range []struct {
+		man  string
+		want int
+	}{{`"ssdp:discover"`, 1}, {`"ssdp:other"`, 0}} {
+		req, _ := http.NewRequest("M-SEARCH", "http://"+addr+"/", nil)
+		req.Header.Set("MAN", tc.man)
+		req.Header.Set("ST", "ssdp:all")
+		n := 0
+		if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(_ net.Addr, res *http.Response) error {
+			if st := res.Header.Get("St"); st != "ssdp:all" {
+				t.Errorf("ST = %q", st)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.want {
+			t.Errorf("MAN %s: got %d responses, want %d", tc.man, n, tc.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package uhttp
+
+import (
+	"container/list"
+	"encoding/binary"
+	"maps"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxTrackedSources is the most per-source rate limiters a Server keeps.  Once it has this
+// many, a new source is only admitted if the least recently seen one has been idle long
+// enough to be forgotten.
+const maxTrackedSources = 4096
+
+// trustedSenderTimeout is how long a sender is trusted for reassembly after its last validly
+// signed request.
+const trustedSenderTimeout = 10 * time.Minute
+
+// Reasons a Server refuses to answer a source, as reported in its logs.
+const (
+	refuseMulticast = "multicast source"
+	refuseBroadcast = "broadcast source"
+	refuseOffLink   = "off-link source"
+	refuseRate      = "rate limited"
+)
+
+// sourceGuard applies a Server's source restrictions to incoming packets.
+type sourceGuard struct {
+	s     *Server
+	links []netip.Prefix
+
+	mu      sync.Mutex
+	max     int
+	buckets map[netip.Addr]*list.Element // of *sourceBucket, in lru
+	lru     list.List                    // most recently seen first
+}
+
+type sourceBucket struct {
+	ip netip.Addr
+	*tokenBucket
+}
+
+func newSourceGuard(s *Server) *sourceGuard {
+	g := &sourceGuard{s: s, max: maxTrackedSources}
+	g.links, _ = interfacePrefixes("")
+	if s.RateLimit > 0 {
+		g.buckets = make(map[netip.Addr]*list.Element)
+	}
+	return g
+}
+
+// check returns the reason packets from sender should be refused, or "" to accept it.
+// Responses to multicast or broadcast sources are always refused, since those can't be the
+// real origin of a request and answering them would flood the network.
+func (g *sourceGuard) check(now time.Time, sender net.Addr) string {
+	ip, ok := senderIP(sender)
+	if !ok {
+		return ""
+	}
+	switch {
+	case ip.IsMulticast():
+		return refuseMulticast
+	case ip == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || g.isSubnetBroadcast(ip):
+		return refuseBroadcast
+	case g.s.OnLinkOnly && !containsAddr(g.links, ip):
+		return refuseOffLink
+	}
+	if g.buckets != nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		b := g.bucket(now, ip)
+		if b == nil || !b.take(now, 1) {
+			return refuseRate
+		}
+	}
+	return ""
+}
+
+// bucket returns the rate limiter for ip, creating one if there's room, or nil if there isn't.
+// g.mu must be held.
+func (g *sourceGuard) bucket(now time.Time, ip netip.Addr) *tokenBucket {
+	if e := g.buckets[ip]; e != nil {
+		g.lru.MoveToFront(e)
+		return e.Value.(*sourceBucket).tokenBucket
+	}
+	if len(g.buckets) >= g.max {
+		// A source that has been idle long enough for its bucket to refill can be forgotten,
+		// since a new bucket would behave identically.  If even the least recently seen source
+		// isn't, the table is full of active sources, and new ones must wait.
+		oldest := g.lru.Back()
+		full := time.Duration(float64(g.s.RateBurst+1) / g.s.RateLimit * float64(time.Second))
+		if now.Sub(oldest.Value.(*sourceBucket).last) < full {
+			return nil
+		}
+		delete(g.buckets, oldest.Value.(*sourceBucket).ip)
+		g.lru.Remove(oldest)
+	}
+	b := &sourceBucket{ip, newTokenBucket(g.s.RateLimit, g.s.RateBurst, now)}
+	g.buckets[ip] = g.lru.PushFront(b)
+	return b.tokenBucket
+}
+
+// isSubnetBroadcast reports whether ip is the broadcast address of a connected IPv4 subnet.
+func (g *sourceGuard) isSubnetBroadcast(ip netip.Addr) bool {
+	if !ip.Is4() {
+		return false
+	}
+	for _, p := range g.links {
+		if !p.Addr().Is4() || p.Bits() >= 31 || !p.Contains(ip) {
+			continue
+		}
+		// It's the broadcast address if all of its host bits are set.
+		b := ip.As4()
+		host := uint32(1)<<(32-p.Bits()) - 1
+		if binary.BigEndian.Uint32(b[:])&host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// byteBudget is the number of bytes that may still be sent in response to a request, including
+// retransmitted fragments.  A nil *byteBudget is unlimited.
+type byteBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+// responseBudget returns the budget for responses to a request of reqSize bytes, or nil if there
+// is no limit.
+func (s *Server) responseBudget(reqSize int) *byteBudget {
+	if s.MaxAmplification <= 0 {
+		return nil
+	}
+	return &byteBudget{left: int(s.MaxAmplification * float64(reqSize))}
+}
+
+// spend deducts n bytes from b, and reports whether there was room for them.
+func (b *byteBudget) spend(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.left {
+		return false
+	}
+	b.left -= n
+	return true
+}
+
+// credit adds n bytes to b.
+func (b *byteBudget) credit(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.left += n
+}
+
+// trusted reports whether the fragmented requests of sender may be reassembled under the full
+// limits: if s has no Signer, or sender has recently sent a validly signed request.  Others
+// could be anyone, since a request's signature can't be checked until it is reassembled.
+// s.mu must be held.
+func (s *Server) trusted(now time.Time, sender net.Addr) bool {
+	if s.Signer == nil {
+		return true
+	}
+	ip, ok := senderIP(sender)
+	t, seen := s.signed[ip]
+	return ok && seen && now.Sub(t) < trustedSenderTimeout
+}
+
+// markSigned records that sender has sent a validly signed request.  Once maxTrackedSources
+// senders are remembered, new ones are only added as old ones expire.  s.mu must be held.
+func (s *Server) markSigned(now time.Time, sender net.Addr) {
+	ip, ok := senderIP(sender)
+	if !ok {
+		return
+	}
+	if s.signed == nil {
+		s.signed = make(map[netip.Addr]time.Time)
+	}
+	if _, seen := s.signed[ip]; !seen && len(s.signed) >= maxTrackedSources {
+		maps.DeleteFunc(s.signed, func(_ netip.Addr, t time.Time) bool { return now.Sub(t) >= trustedSenderTimeout })
+		if len(s.signed) >= maxTrackedSources {
+			return
+		}
+	}
+	s.signed[ip] = now
+}
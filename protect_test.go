@@ -0,0 +1,193 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSourceGuard(t *testing.T) {
+	udp := func(s string) net.Addr { return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s)) }
+	links := []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("10.0.0.0/31")}
+	now := time.Unix(0, 0)
+
+	for _, c := range []struct {
+		onLink bool
+		sender string
+		want   string
+	}{
+		{false, "192.168.1.5:1900", ""},
+		{false, "203.0.113.1:1900", ""},
+		{true, "203.0.113.1:1900", refuseOffLink},
+		{true, "192.168.1.5:1900", ""},
+		{false, "239.255.255.250:1900", refuseMulticast},
+		{false, "[ff02::c]:1900", refuseMulticast},
+		{false, "255.255.255.255:1900", refuseBroadcast},
+		{false, "192.168.1.255:1900", refuseBroadcast},
+		{false, "10.0.0.1:1900", ""}, // no broadcast address in a /31
+	} {
+		g := &sourceGuard{s: &Server{OnLinkOnly: c.onLink}, links: links}
+		if got := g.check(now, udp(c.sender)); got != c.want {
+			t.Errorf("check(%s, onLink=%v) = %q, want %q", c.sender, c.onLink, got, c.want)
+		}
+	}
+}
+
+func TestSourceGuardRate(t *testing.T) {
+	s := &Server{RateLimit: 1, RateBurst: 2}
+	g := newSourceGuard(s)
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1}
+	now := time.Unix(0, 0)
+
+	var got []string
+	for _, addr := range []net.Addr{a, a, a, b} {
+		got = append(got, g.check(now, addr))
+	}
+	if got[0] != "" || got[1] != "" || got[2] != refuseRate || got[3] != "" {
+		t.Errorf("check results = %q", got)
+	}
+	if r := g.check(now.Add(time.Second), a); r != "" {
+		t.Errorf("check after refill = %q", r)
+	}
+
+}
+
+func TestSourceGuardCap(t *testing.T) {
+	s := &Server{RateLimit: 1, RateBurst: 1}
+	g := newSourceGuard(s)
+	g.max = 3
+	addr := func(i int) net.Addr { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 1} }
+	now := time.Unix(0, 0)
+
+	for i := range 3 {
+		if r := g.check(now, addr(i)); r != "" {
+			t.Fatalf("source %d: check = %q", i, r)
+		}
+	}
+	// The table is full of active sources, so a new one (such as a spoofed address) is refused
+	// rather than being given a burst of its own.
+	if r := g.check(now, addr(3)); r != refuseRate {
+		t.Errorf("new source with a full table: check = %q, want %q", r, refuseRate)
+	}
+	if len(g.buckets) != 3 || g.lru.Len() != 3 {
+		t.Errorf("tracking %d sources, want 3", len(g.buckets))
+	}
+
+	// Once the least recently seen source has gone idle, it makes room.
+	later := now.Add(5 * time.Second)
+	g.check(later, addr(0)) // seen again, so no longer the oldest
+	if r := g.check(later, addr(3)); r != "" {
+		t.Errorf("new source after one went idle: check = %q", r)
+	}
+	if _, ok := g.buckets[netip.MustParseAddr("192.0.2.1")]; ok {
+		t.Error("least recently seen source was not the one evicted")
+	}
+	if _, ok := g.buckets[netip.MustParseAddr("192.0.2.0")]; !ok {
+		t.Error("recently seen source was evicted")
+	}
+	if len(g.buckets) != 3 {
+		t.Errorf("tracking %d sources, want 3", len(g.buckets))
+	}
+}
+
+// recordConn is a PacketConn that records what is written to it.
+type recordConn struct {
+	net.PacketConn
+	sent [][]byte
+}
+
+func (c *recordConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.sent = append(c.sent, slices.Clone(b))
+	return len(b), nil
+}
+
+func TestAmplificationCharged(t *testing.T) {
+	m := &MemoryMetrics{}
+	s := &Server{Fragmentation: true, MaxAmplification: 1, Metrics: m}
+	log := slog.New(slog.DiscardHandler)
+	sender := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}
+	req := &http.Request{Header: http.Header{acceptFragmentsHeader: {"1024"}}}
+	data := append([]byte("HTTP/1.1 200 OK\r\nContent-Length: 3000\r\n\r\n"), bytes.Repeat([]byte("x"), 3000)...)
+	conn := &recordConn{}
+
+	// The fragment headers push the response over a budget the body alone would fit.
+	if err := s.send(conn, sender, req, data, &byteBudget{left: len(data)}, log); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("send = %v, want ErrResponseTooLarge", err)
+	}
+	if len(conn.sent) != 0 || len(s.sent) != 0 {
+		t.Fatalf("sent %d packets over budget", len(conn.sent))
+	}
+
+	budget := &byteBudget{left: 4000}
+	if err := s.send(conn, sender, req, data, budget, log); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, p := range conn.sent {
+		total += len(p)
+	}
+	if len(conn.sent) < 2 || budget.left != 4000-total {
+		t.Fatalf("sent %d packets of %d bytes, budget left %d", len(conn.sent), total, budget.left)
+	}
+	frags := conn.sent
+	var id string
+	for k := range s.sent {
+		id = k.id
+	}
+
+	resend := func() int {
+		conn.sent = nil
+		b := newResend(id, []int{0, 1})
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.resend(conn, sender, r, len(b), log)
+		return len(b)
+	}
+
+	budget.left = 0
+	resend()
+	if len(conn.sent) != 0 {
+		t.Errorf("retransmitted %d fragments without budget", len(conn.sent))
+	}
+	if got := m.Snapshot().Counters[MetricAmplificationLimited]; got != 2 {
+		t.Errorf("%s = %d, want 2", MetricAmplificationLimited, got)
+	}
+
+	budget.left = 10000
+	n := resend()
+	if len(conn.sent) != 2 {
+		t.Fatalf("retransmitted %d fragments, want 2", len(conn.sent))
+	}
+	if want := 10000 + n - len(frags[0]) - len(frags[1]); budget.left != want {
+		t.Errorf("budget left %d after retransmission, want %d", budget.left, want)
+	}
+}
+
+func TestServerTrusted(t *testing.T) {
+	now := time.Unix(0, 0)
+	sender := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}
+	if !(&Server{}).trusted(now, sender) {
+		t.Error("sender untrusted without a Signer")
+	}
+	s := &Server{Signer: NewSigner("k1", []byte("secret"))}
+	if s.trusted(now, sender) {
+		t.Error("sender trusted before sending a signed request")
+	}
+	s.markSigned(now, sender)
+	if !s.trusted(now.Add(time.Minute), &net.UDPAddr{IP: sender.IP, Port: 1234}) {
+		t.Error("sender untrusted after sending a signed request")
+	}
+	if s.trusted(now.Add(trustedSenderTimeout), sender) {
+		t.Error("sender still trusted after trustedSenderTimeout")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package uhttp
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,113 @@
+package uhttp
+
+import (
+	"net"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter.  It holds up to burst tokens, refilled at rate per
+// second.  It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(max(burst, 1))
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// take removes n tokens from the bucket if it has them, and reports whether it did.
+func (b *tokenBucket) take(now time.Time, n float64) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// RoundTripStats summarizes the packets received during a round trip.  It is reported to
+// ClientTrace.Finished when the round trip returns.
+type RoundTripStats struct {
+	Packets   int // packets received
+	Responses int // responses delivered to the caller
+	Rejected  int // packets discarded per Transport.AcceptFrom
+
+	// Packets discarded unparsed because of Transport.MaxParsedResponses,
+	// Transport.MaxParsedResponsesPerSender, and Transport.ReceiveRate, respectively.
+	DroppedOverMax       int
+	DroppedOverPerSender int
+	DroppedOverRate      int
+}
+
+// Dropped returns the total number of packets dropped because of receive limits.
+func (s RoundTripStats) Dropped() int {
+	return s.DroppedOverMax + s.DroppedOverPerSender + s.DroppedOverRate
+}
+
+// maxTrackedSenders is the number of senders whose packets a receiveLimiter counts separately.
+// Senders beyond this share a single count, so that a flood of forged source addresses can't
+// grow the limiter without bound.
+const maxTrackedSenders = 1024
+
+// overflowSender is the bySender key shared by senders beyond maxTrackedSenders.
+const overflowSender = ""
+
+// receiveLimiter applies a Transport's receive limits to the packets of one round trip.
+type receiveLimiter struct {
+	max, perSender int
+	admitted       int
+	bySender       map[string]int
+	bucket         *tokenBucket
+}
+
+func (t *Transport) newReceiveLimiter() *receiveLimiter {
+	l := &receiveLimiter{max: t.MaxParsedResponses, perSender: t.MaxParsedResponsesPerSender}
+	if l.perSender > 0 {
+		l.bySender = make(map[string]int)
+	}
+	if t.ReceiveRate > 0 {
+		l.bucket = newTokenBucket(t.ReceiveRate, t.ReceiveBurst, t.clock().Now())
+	}
+	return l
+}
+
+// key returns the bySender key under which packets from sender are counted.
+func (l *receiveLimiter) key(sender net.Addr) string {
+	key := senderKey(sender)
+	if _, ok := l.bySender[key]; !ok && len(l.bySender) >= maxTrackedSenders {
+		return overflowSender
+	}
+	return key
+}
+
+// admit decides whether a packet from sender may be parsed, and if not, counts it as dropped in
+// stats.
+func (l *receiveLimiter) admit(now time.Time, sender net.Addr, stats *RoundTripStats) bool {
+	var key string
+	if l.bySender != nil {
+		key = l.key(sender)
+	}
+	switch {
+	case l.max > 0 && l.admitted >= l.max:
+		stats.DroppedOverMax++
+		return false
+	case l.perSender > 0 && l.bySender[key] >= l.perSender:
+		stats.DroppedOverPerSender++
+		return false
+	case l.bucket != nil && !l.bucket.take(now, 1):
+		stats.DroppedOverRate++
+		return false
+	}
+	l.admitted++
+	if l.bySender != nil {
+		l.bySender[key]++
+	}
+	return true
+}
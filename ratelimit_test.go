@@ -0,0 +1,91 @@
+package uhttp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, 3, now)
+	for i := range 3 {
+		if !b.take(now, 1) {
+			t.Fatalf("take %d failed within burst", i)
+		}
+	}
+	if b.take(now, 1) {
+		t.Fatal("take succeeded past burst")
+	}
+	if !b.take(now.Add(500*time.Millisecond), 1) {
+		t.Error("take failed after refill")
+	}
+	if b.take(now.Add(500*time.Millisecond), 1) {
+		t.Error("take succeeded before refill")
+	}
+	// Refill is capped at the burst size.
+	later := now.Add(time.Hour)
+	for i := range 3 {
+		if !b.take(later, 1) {
+			t.Fatalf("take %d failed after long idle", i)
+		}
+	}
+	if b.take(later, 1) {
+		t.Error("bucket refilled past burst")
+	}
+}
+
+func TestReceiveLimiter(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1900}
+	a2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1901}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1900}
+	now := time.Unix(0, 0)
+
+	tr := &Transport{MaxParsedResponses: 4, MaxParsedResponsesPerSender: 2}
+	l := tr.newReceiveLimiter()
+	var stats RoundTripStats
+	var admitted int
+	for _, addr := range []net.Addr{a, a2, a, b, b, b, a} {
+		if l.admit(now, addr, &stats) {
+			admitted++
+		}
+	}
+	// a and a2 share an IP, so the third packet from it is over the per-sender limit, and the
+	// last two are over the total.
+	if admitted != 4 || stats.DroppedOverPerSender != 1 || stats.DroppedOverMax != 2 {
+		t.Errorf("admitted %d, stats %+v", admitted, stats)
+	}
+
+	// Senders beyond maxTrackedSenders share one count.
+	tr = &Transport{MaxParsedResponsesPerSender: 2}
+	l = tr.newReceiveLimiter()
+	stats = RoundTripStats{}
+	for i := range maxTrackedSenders + 10 {
+		l.admit(now, &net.UDPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1900}, &stats)
+	}
+	if len(l.bySender) != maxTrackedSenders+1 || stats.DroppedOverPerSender != 8 {
+		t.Errorf("tracking %d senders, stats %+v", len(l.bySender), stats)
+	}
+	first := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 0), Port: 1900}
+	if !l.admit(now, first, &stats) || l.admit(now, first, &stats) {
+		t.Error("a tracked sender wasn't limited on its own count")
+	}
+
+	tr = &Transport{ReceiveRate: 1, ReceiveBurst: 2, Clock: fixedClock{now}}
+	l = tr.newReceiveLimiter()
+	stats = RoundTripStats{}
+	for range 5 {
+		l.admit(now, a, &stats)
+	}
+	l.admit(now.Add(time.Second), a, &stats)
+	if stats.DroppedOverRate != 3 || stats.Dropped() != 3 {
+		t.Errorf("stats %+v, want 3 dropped over rate", stats)
+	}
+}
+
+// fixedClock is a Clock that always returns the same time.
+type fixedClock struct{ now time.Time }
+
+func (c fixedClock) Now() time.Time                         { return c.now }
+func (c fixedClock) After(d time.Duration) <-chan time.Time { return SystemClock.After(d) }
+func (c fixedClock) NewTimer(d time.Duration) Timer         { return SystemClock.NewTimer(d) }
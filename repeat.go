@@ -2,6 +2,7 @@ package uhttp
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -59,20 +60,55 @@ func RepeatJoin(gens ...RepeatGenerator) RepeatGenerator {
 	}
 }
 
-// randomDuration returns a duration between low and high.
-func randomDuration(low, high time.Duration) time.Duration {
+// lockedRand guards a rand.Rand so that it can be shared by RepeatFuncs running concurrently.
+// A nil *lockedRand draws from the global math/rand source.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	if src == nil {
+		return nil
+	}
+	return &lockedRand{r: rand.New(src)}
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	if l == nil {
+		return rand.Int63n(n)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
+
+// randomDuration returns a duration between [low, high), drawn from r.  If low == high, returns low.
+func randomDuration(r *lockedRand, low, high time.Duration) time.Duration {
 	if low > high {
 		low, high = high, low
 	}
-	return time.Duration(rand.Int63n(int64(high)-int64(low)) + int64(low))
+	if low == high {
+		return low
+	}
+	return time.Duration(r.Int63n(int64(high)-int64(low)) + int64(low))
 }
 
 // RepeatRandom generates a RepeatFunc that returns a random duration between [low, high), num
 // times, and then returns nil.  If num is 0, this will return delays forever.
 func RepeatRandom(low, high time.Duration, num int) RepeatGenerator {
+	return RepeatRandomWith(nil, low, high, num)
+}
+
+// RepeatRandomWith is like RepeatRandom, but draws its random durations from src, so that the
+// resulting schedules are reproducible.  All RepeatFuncs produced by the generator share src,
+// which is locked internally and so need not be safe for concurrent use.  A nil src uses the
+// global math/rand source.
+func RepeatRandomWith(src rand.Source, low, high time.Duration, num int) RepeatGenerator {
 	if num == 0 {
 		num = -1
 	}
+	r := newLockedRand(src)
 	return func() RepeatFunc {
 		num := num
 		return func(_ time.Duration) *time.Duration {
@@ -81,7 +117,7 @@ func RepeatRandom(low, high time.Duration, num int) RepeatGenerator {
 				num--
 				fallthrough
 			case num < 0:
-				d := randomDuration(low, high)
+				d := randomDuration(r, low, high)
 				return &d
 			default:
 				return nil
@@ -2,6 +2,7 @@ package uhttp
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -54,6 +55,41 @@ func doTestRepeatAfterever(t *testing.T, desc string, expected string, fn Repeat
 	}
 }
 
+func TestRepeatRandomWith(t *testing.T) {
+	collect := func(fn RepeatFunc) []time.Duration {
+		var got []time.Duration
+		for r := fn(0); r != nil; r = fn(*r) {
+			got = append(got, *r)
+		}
+		return got
+	}
+
+	a := collect(RepeatRandomWith(rand.NewSource(42), 5, 1000, 5)())
+	b := collect(RepeatRandomWith(rand.NewSource(42), 5, 1000, 5)())
+	if len(a) != 5 {
+		t.Fatalf("expected 5 delays, got %v", a)
+	}
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("same seed should produce same delays, got %v and %v", a, b)
+	}
+	for _, d := range a {
+		if d < 5 || d >= 1000 {
+			t.Errorf("expected delays in [5, 1000), got %v", a)
+			break
+		}
+	}
+}
+
+func TestRandomDurationEqual(t *testing.T) {
+	if d := randomDuration(nil, 7, 7); d != 7 {
+		t.Errorf("randomDuration(7, 7) should return 7, got %v", d)
+	}
+	r := newLockedRand(rand.NewSource(1))
+	if d := randomDuration(r, 10, 5); d < 5 || d >= 10 {
+		t.Errorf("randomDuration(10, 5) should return a value in [5, 10), got %v", d)
+	}
+}
+
 func ExampleRepeatJoin() {
 	tenHzFor3 := RepeatAfter(time.Second/10, 3)
 	oneHz := RepeatAfter(time.Second, 0)
@@ -0,0 +1,255 @@
+package uhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// AutoHeader is a set of the headers that WriteRequest generates itself, rather than taking
+// them from http.Request.Header.
+type AutoHeader uint
+
+const (
+	// AutoHost is the Host header, taken from req.Host or req.URL.Host.
+	AutoHost AutoHeader = 1 << iota
+
+	// AutoUserAgent is the User-Agent header.  A default is used unless req.Header provides
+	// one, and it is omitted if that value is empty.
+	AutoUserAgent
+
+	// AutoContentLength is the Content-Length header, sent when the request has a body.
+	AutoContentLength
+)
+
+const defaultUserAgent = "Go-http-client/1.1"
+
+// excludedHeaders are headers in req.Header that are never written, since WriteRequest
+// generates them itself or they make no sense for a single datagram.
+var excludedHeaders = map[string]bool{
+	"Host":              true,
+	"User-Agent":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+}
+
+// keysPool holds slices used to sort header names without allocating.
+var keysPool = sync.Pool{
+	New: func() any { return new([]string) },
+}
+
+// appendRequest appends req to dst in wire format.  The request line is written first,
+// followed by the automatic headers Host, User-Agent and Content-Length (unless omitted per
+// t.OmitAutoHeaders), then the headers in req.Header sorted by name, then the body.  Header
+// names are passed through t.HeaderCanon.  req.Body is read in full and closed.
+//
+// If req's context carries an OrderedHeader, its fields are written exactly in place of
+// req.Header, and any automatic headers it already contains are not generated.
+//
+// If the result would be larger than limit, returns an error wrapping ErrRequestTooLarge.  No
+// allocations are made if dst has room for the request.
+func (t *Transport) appendRequest(dst []byte, req *http.Request, limit int) ([]byte, error) {
+	return t.appendMessage(dst, req, limit, t.Fragmentation)
+}
+
+// appendMessage is appendRequest, but offers to reassemble fragmented responses only if
+// acceptFragments is set.
+func (t *Transport) appendMessage(dst []byte, req *http.Request, limit int, acceptFragments bool) (_ []byte, err error) {
+	defer func() {
+		if err == nil && len(dst) > limit {
+			err = fmt.Errorf("%w of %d", ErrRequestTooLarge, limit)
+		}
+		if errors.Is(err, ErrRequestTooLarge) {
+			t.metrics().Add(MetricOversizeRequests, 1)
+		}
+	}()
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	dst = append(dst, method...)
+	dst = append(dst, ' ')
+	dst = append(dst, req.URL.RequestURI()...)
+	dst = append(dst, " HTTP/1.1\r\n"...)
+
+	oh := ContextOrderedHeader(req.Context())
+	auto := func(which AutoHeader, name string) bool {
+		return t.OmitAutoHeaders&which == 0 && !oh.Has(name)
+	}
+
+	if auto(AutoHost, "Host") {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		host = removeZone(host)
+		if !httpguts.ValidHostHeader(host) {
+			return dst, fmt.Errorf("uhttp: invalid Host %q", host)
+		}
+		dst = t.appendHeader(dst, "Host", host)
+	}
+	if auto(AutoUserAgent, "User-Agent") {
+		ua := defaultUserAgent
+		if _, ok := req.Header["User-Agent"]; ok && oh == nil {
+			ua = req.Header.Get("User-Agent")
+		}
+		if ua != "" {
+			dst = t.appendHeader(dst, "User-Agent", ua)
+		}
+	}
+
+	// Content-Length goes here, but we won't know it until we've read the body.
+	clPos := len(dst)
+
+	if oh != nil {
+		for _, f := range oh {
+			dst = appendField(dst, f.Name, f.Value)
+		}
+	} else {
+		kp := keysPool.Get().(*[]string)
+		keys := (*kp)[:0]
+		for k := range req.Header {
+			if !excludedHeaders[k] {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			for _, v := range req.Header[k] {
+				dst = t.appendHeader(dst, k, v)
+			}
+		}
+		clear(keys)
+		*kp = keys[:0]
+		keysPool.Put(kp)
+	}
+	if acceptFragments {
+		dst = appendField(dst, acceptFragmentsHeader, strconv.Itoa(t.maxResponseSize()))
+	}
+	dst = append(dst, "\r\n"...)
+
+	if len(dst) > limit {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return dst, nil // reported by the deferred check
+	}
+	bodyStart := len(dst)
+	if dst, err = readBody(dst, req.Body, limit); err != nil {
+		return dst, err
+	}
+	bodyLen := len(dst) - bodyStart
+	if req.ContentLength > 0 && int64(bodyLen) != req.ContentLength {
+		return dst, fmt.Errorf("uhttp: http.Request.ContentLength=%d with Body length %d", req.ContentLength, bodyLen)
+	}
+
+	if auto(AutoContentLength, "Content-Length") && (bodyLen > 0 || method == "POST" || method == "PUT" || method == "PATCH") {
+		var lb [64]byte
+		if line := t.appendHeader(lb[:0], "Content-Length", ""); len(line) > 0 {
+			line = strconv.AppendInt(line[:len(line)-2], int64(bodyLen), 10)
+			line = append(line, "\r\n"...)
+			dst = insertAt(dst, clPos, line)
+		}
+	}
+	return dst, nil
+}
+
+// appendHeader appends a header line for name and value to dst, with name passed through
+// t.HeaderCanon.  If that results in an empty name, the header is omitted.
+func (t *Transport) appendHeader(dst []byte, name, value string) []byte {
+	if t.HeaderCanon != nil {
+		if name = t.HeaderCanon(name); name == "" {
+			return dst
+		}
+	}
+	return appendField(dst, name, strings.TrimSpace(value))
+}
+
+// appendField appends a header line for name and value to dst, exactly as given except that
+// any CR or LF in value is replaced by a space, as net/http does, so that it can't start
+// another header line.
+func appendField(dst []byte, name, value string) []byte {
+	dst = append(dst, name...)
+	dst = append(dst, ": "...)
+	if !strings.ContainsAny(value, "\r\n") {
+		dst = append(dst, value...)
+	} else {
+		for i := range len(value) {
+			if c := value[i]; c == '\r' || c == '\n' {
+				dst = append(dst, ' ')
+			} else {
+				dst = append(dst, c)
+			}
+		}
+	}
+	return append(dst, "\r\n"...)
+}
+
+// insertAt inserts data into b at position pos, shifting the remainder of b to make room.
+func insertAt(b []byte, pos int, data []byte) []byte {
+	n := len(b)
+	b = append(b, data...)
+	copy(b[pos+len(data):], b[pos:n])
+	copy(b[pos:], data)
+	return b
+}
+
+// readBody reads all of body into dst and closes it.  If doing so would make dst larger than
+// limit, returns an error wrapping ErrRequestTooLarge.
+func readBody(dst []byte, body io.ReadCloser, limit int) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return dst, nil
+	}
+	defer body.Close()
+	for {
+		if len(dst) >= limit {
+			// See if there's anything left.
+			var probe [1]byte
+			n, err := io.ReadAtLeast(body, probe[:], 1)
+			if n > 0 {
+				return dst, fmt.Errorf("%w of %d", ErrRequestTooLarge, limit)
+			}
+			if err == io.EOF {
+				return dst, nil
+			}
+			return dst, err
+		}
+		if len(dst) == cap(dst) {
+			dst = slices.Grow(dst, min(max(cap(dst), 512), limit-len(dst)))
+		}
+		n, err := body.Read(dst[len(dst):min(cap(dst), limit)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
+
+// removeZone removes the IPv6 zone identifier from host, since it has no meaning to the
+// recipient of a Host header.
+func removeZone(host string) string {
+	if !strings.HasPrefix(host, "[") {
+		return host
+	}
+	i := strings.LastIndex(host, "]")
+	if i < 0 {
+		return host
+	}
+	j := strings.LastIndex(host[:i], "%")
+	if j < 0 {
+		return host
+	}
+	return host[:j] + host[i:]
+}
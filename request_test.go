@@ -0,0 +1,240 @@
+package uhttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteRequestMatchesStock(t *testing.T) {
+	type testcase struct {
+		desc string
+		req  func() *http.Request
+	}
+
+	cases := []testcase{
+		{"simple get", func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/path?q=1", nil)
+			req.Header.Add("X-One", "1")
+			req.Header.Add("A-Two", "2")
+			req.Header.Add("A-Two", "3")
+			return req
+		}},
+		{"m-search", func() *http.Request {
+			req, _ := http.NewRequest("M-SEARCH", "", nil)
+			req.URL.Host = "239.255.255.250:1900"
+			req.URL.Path = "*"
+			req.Header.Add("MAN", `"ssdp:discover"`)
+			req.Header.Add("ST", "upnp:rootdevice")
+			return req
+		}},
+		{"post with body", func() *http.Request {
+			req, _ := http.NewRequest("POST", "http://127.0.0.1:1900/", strings.NewReader("hello"))
+			return req
+		}},
+		{"post without body", func() *http.Request {
+			req, _ := http.NewRequest("POST", "http://127.0.0.1:1900/", nil)
+			return req
+		}},
+		{"custom user agent", func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+			req.Header.Set("User-Agent", "test/1.0")
+			return req
+		}},
+		{"empty user agent", func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+			req.Header.Set("User-Agent", "")
+			return req
+		}},
+		{"ipv6 zone", func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://[fe80::1%25eth0]:1900/", nil)
+			return req
+		}},
+	}
+
+	tr := &Transport{}
+	for _, c := range cases {
+		var expected, actual bytes.Buffer
+		if err := c.req().Write(&expected); err != nil {
+			t.Fatalf("%s: stock Write failed: %v", c.desc, err)
+		}
+		if err := tr.WriteRequest(&actual, c.req()); err != nil {
+			t.Errorf("%s: did not expect error, got %v", c.desc, err)
+			continue
+		}
+		if actual.String() != expected.String() {
+			t.Errorf("%s: expected %q, got %q", c.desc, expected.String(), actual.String())
+		}
+	}
+}
+
+func TestWriteRequestInjection(t *testing.T) {
+	badHost := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+		req.Host = "evil\r\nX-Injected: 1"
+		return req
+	}
+	badValue := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+		req.Header.Set("St", "a\r\nX-Injected: 1")
+		return req
+	}
+	tr := &Transport{}
+	for desc, req := range map[string]func() *http.Request{"host": badHost, "value": badValue} {
+		var buf bytes.Buffer
+		if err := tr.WriteRequest(&buf, req()); err == nil {
+			t.Errorf("WriteRequest with CRLF in %s succeeded: %q", desc, buf.String())
+		}
+		if err := tr.RoundTripMulti(req(), time.Millisecond, func(net.Addr, *http.Response) error { return nil }); err == nil {
+			t.Errorf("RoundTripMulti with CRLF in %s succeeded", desc)
+		}
+	}
+
+	// The serializer doesn't rely on validation having been done.
+	if _, err := tr.appendRequest(nil, badHost(), tr.maxRequestSize()); err == nil {
+		t.Error("appendRequest with CRLF in host succeeded")
+	}
+	data, err := tr.appendRequest(nil, badValue(), tr.maxRequestSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("\nX-Injected")) {
+		t.Errorf("header value injected a line: %q", data)
+	}
+}
+
+func TestWriteRequestCanon(t *testing.T) {
+	type testcase struct {
+		desc     string
+		retain   []string
+		expected string
+	}
+
+	cases := []testcase{
+		{"should do nothing", []string{"One", "Two"}, "One: 1\r\nTwo: 2\r\n\r\n"},
+		{"strip first", []string{"Two"}, "Two: 2\r\n\r\n"},
+		{"strip last", []string{"One"}, "One: 1\r\n\r\n"},
+		{"strip all", []string{}, "\r\n"},
+		{"case change", []string{"oNE", "tWO"}, "oNE: 1\r\ntWO: 2\r\n\r\n"},
+	}
+
+	for _, c := range cases {
+		tr := &Transport{
+			HeaderCanon: func(name string) string {
+				for _, s := range c.retain {
+					if strings.EqualFold(s, name) {
+						return s
+					}
+				}
+				return ""
+			},
+		}
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:1900/", nil)
+		req.Header.Add("One", "1")
+		req.Header.Add("Two", "2")
+
+		var b bytes.Buffer
+		if err := tr.WriteRequest(&b, req); err != nil {
+			t.Errorf("%s: did not expect error, got %v", c.desc, err)
+			continue
+		}
+		expected := "GET / HTTP/1.1\r\n" + c.expected
+		if actual := b.String(); actual != expected {
+			t.Errorf("%s: expected %q, got %q", c.desc, expected, actual)
+		}
+	}
+}
+
+func TestWriteRequestBody(t *testing.T) {
+	// Lines in the body that look like headers must not be touched.
+	tr := &Transport{
+		HeaderCanon:     strings.ToUpper,
+		OmitAutoHeaders: AutoUserAgent,
+	}
+	req, _ := http.NewRequest("NOTIFY", "http://127.0.0.1:1900/", io.NopCloser(strings.NewReader("x-body: 1\r\n")))
+	var b bytes.Buffer
+	if err := tr.WriteRequest(&b, req); err != nil {
+		t.Fatalf("did not expect error, got %v", err)
+	}
+	expected := "NOTIFY / HTTP/1.1\r\nHOST: 127.0.0.1:1900\r\nCONTENT-LENGTH: 11\r\n\r\nx-body: 1\r\n"
+	if actual := b.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+
+	tr = &Transport{OmitAutoHeaders: AutoHost | AutoUserAgent | AutoContentLength}
+	req, _ = http.NewRequest("POST", "http://127.0.0.1:1900/", strings.NewReader("abc"))
+	b.Reset()
+	if err := tr.WriteRequest(&b, req); err != nil {
+		t.Fatalf("did not expect error, got %v", err)
+	}
+	if expected, actual := "POST / HTTP/1.1\r\n\r\nabc", b.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestWriteRequestTooLarge(t *testing.T) {
+	type testcase struct {
+		desc string
+		body string
+		fits bool
+	}
+	header := "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 2\r\n\r\n"
+	cases := []testcase{
+		{"exact fit", "ab", true},
+		{"body too large", "abc", false},
+		{"headers too large", strings.Repeat("x", 100), false},
+	}
+	for _, c := range cases {
+		tr := &Transport{MaxSize: len(header) + 2, OmitAutoHeaders: AutoUserAgent}
+		req, _ := http.NewRequest("POST", "http://h/", io.NopCloser(strings.NewReader(c.body)))
+		err := tr.WriteRequest(io.Discard, req)
+		if c.fits && err != nil {
+			t.Errorf("%s: did not expect error, got %v", c.desc, err)
+		}
+		if !c.fits && !errors.Is(err, ErrRequestTooLarge) {
+			t.Errorf("%s: expected ErrRequestTooLarge, got %v", c.desc, err)
+		}
+	}
+}
+
+// raceEnabled is set when built with the race detector, which adds allocations of its own.
+var raceEnabled bool
+
+func TestWriteRequestAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not meaningful with the race detector")
+	}
+	tr := &Transport{}
+	req, _ := http.NewRequest("M-SEARCH", "http://239.255.255.250:1900/", nil)
+	req.URL.Path = "*"
+	req.Header.Add("MAN", `"ssdp:discover"`)
+	req.Header.Add("MX", "1")
+	req.Header.Add("ST", "upnp:rootdevice")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := tr.WriteRequest(io.Discard, req); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestSerializeRequestKeepsGrownBuffer(t *testing.T) {
+	tr := &Transport{Fragmentation: true}
+	buf := tr.newBuf()
+	size := cap(*buf)
+	req, _ := http.NewRequest("POST", "http://h/", strings.NewReader(strings.Repeat("x", 3*size)))
+	if _, _, err := tr.serializeRequest(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	if cap(*buf) <= size {
+		t.Errorf("buffer capacity = %d after serializing %d bytes, want the grown buffer kept", cap(*buf), 3*size)
+	}
+}
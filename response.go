@@ -0,0 +1,111 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"weak"
+)
+
+// ResponseInfo describes a response exactly as it was received, before it was parsed into an
+// http.Response, which canonicalizes header names and loses their order.
+type ResponseInfo struct {
+	// Sender is the address the response was received from.
+	Sender net.Addr
+
+	// StatusLine is the first line of the response, without its line ending.
+	StatusLine string
+
+	// Lines holds the raw header lines, without their line endings, in the order received.
+	Lines []string
+
+	// Header holds the fields parsed from Lines, with names in their original case.  A folded
+	// continuation line is joined to the preceding value with a single space.
+	Header OrderedHeader
+
+	// Quirks lists the deviations from HTTP/1.1 that were corrected in order to parse the
+	// response.  This is only ever non-zero with Transport.LenientParsing.
+	Quirks Quirk
+}
+
+// responseInfos maps weak pointers to the responses delivered by a Transport to their
+// ResponseInfo.  Entries are removed once their response is garbage collected.
+var responseInfos sync.Map // map[weak.Pointer[http.Response]]*ResponseInfo
+
+// ResponseInfoFor returns the ResponseInfo for res, or nil if res was not delivered by a
+// Transport.
+func ResponseInfoFor(res *http.Response) *ResponseInfo {
+	if res == nil {
+		return nil
+	}
+	info, _ := responseInfos.Load(weak.Make(res))
+	ri, _ := info.(*ResponseInfo)
+	return ri
+}
+
+// Info returns the ResponseInfo for r, as with ResponseInfoFor.
+func (r Response) Info() *ResponseInfo {
+	return ResponseInfoFor(r.Response)
+}
+
+// attachResponseInfo records info for res, so that it is available from ResponseInfoFor.  res
+// itself is left unchanged.
+func attachResponseInfo(res *http.Response, info *ResponseInfo) {
+	key := weak.Make(res)
+	responseInfos.Store(key, info)
+	runtime.AddCleanup(res, func(key weak.Pointer[http.Response]) { responseInfos.Delete(key) }, key)
+}
+
+// newResponseInfo builds a ResponseInfo from the raw response in data.
+func newResponseInfo(sender net.Addr, data []byte) *ResponseInfo {
+	info := &ResponseInfo{Sender: sender}
+	for i := 0; len(data) > 0; i++ {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if i == 0 {
+			info.StatusLine = string(line)
+			continue
+		}
+		if len(line) == 0 {
+			break
+		}
+		s := string(line)
+		info.Lines = append(info.Lines, s)
+
+		if s[0] == ' ' || s[0] == '\t' {
+			if n := len(info.Header); n > 0 {
+				info.Header[n-1].Value += " " + strings.TrimSpace(s)
+			}
+			continue
+		}
+		if name, value, ok := strings.Cut(s, ":"); ok {
+			info.Header.Add(name, strings.TrimSpace(value))
+		}
+	}
+	return info
+}
+
+// parseResponse parses the response in data, which was received from sender in response to
+// req.  If t.LenientParsing is set, deviations from HTTP/1.1 are corrected first.  On success,
+// a ResponseInfo is attached to the result.
+func (t *Transport) parseResponse(sender net.Addr, data []byte, req *http.Request) (*http.Response, error) {
+	parsed, quirks := data, Quirk(0)
+	if t.LenientParsing {
+		if normalized, q := normalizeResponse(data); q != 0 {
+			parsed, quirks = normalized, q
+		}
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(parsed)), req)
+	if err != nil {
+		return nil, err
+	}
+	info := newResponseInfo(sender, data)
+	info.Quirks = quirks
+	attachResponseInfo(res, info)
+	return res, nil
+}
@@ -0,0 +1,55 @@
+package uhttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestNewResponseInfo(t *testing.T) {
+	sender := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1900}
+	data := "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=1800\r\n" +
+		"ext:\r\n" +
+		"Server: a\r\n" +
+		"\tb\r\n" +
+		"ST: upnp:rootdevice\n" +
+		"\r\n" +
+		"Body: not a header\r\n"
+
+	info := newResponseInfo(sender, []byte(data))
+	if info.Sender != sender {
+		t.Errorf("expected sender %v, got %v", sender, info.Sender)
+	}
+	if info.StatusLine != "HTTP/1.1 200 OK" {
+		t.Errorf("expected status line %q, got %q", "HTTP/1.1 200 OK", info.StatusLine)
+	}
+	expectedLines := `["CACHE-CONTROL: max-age=1800" "ext:" "Server: a" "\tb" "ST: upnp:rootdevice"]`
+	if actual := fmt.Sprintf("%q", info.Lines); actual != expectedLines {
+		t.Errorf("expected lines %s, got %s", expectedLines, actual)
+	}
+	expectedHeader := OrderedHeader{{"CACHE-CONTROL", "max-age=1800"}, {"ext", ""}, {"Server", "a b"}, {"ST", "upnp:rootdevice"}}
+	if fmt.Sprint(info.Header) != fmt.Sprint(expectedHeader) {
+		t.Errorf("expected header %v, got %v", expectedHeader, info.Header)
+	}
+}
+
+func TestResponseInfoFor(t *testing.T) {
+	if ResponseInfoFor(&http.Response{}) != nil {
+		t.Errorf("expected nil info for a response that wasn't received")
+	}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/", nil)
+	res := &http.Response{Request: req}
+	info := &ResponseInfo{StatusLine: "HTTP/1.1 200 OK"}
+	attachResponseInfo(res, info)
+	if got := (Response{Response: res}).Info(); got != info {
+		t.Errorf("expected attached info, got %v", got)
+	}
+	if res.Request != req {
+		t.Errorf("res.Request was replaced")
+	}
+	if ResponseInfoFor(&http.Response{Request: req}) != nil {
+		t.Errorf("another response to the same request should not carry the info")
+	}
+}
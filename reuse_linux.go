@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package uhttp
+
+// soReusePort is SO_REUSEPORT, which package syscall does not define for Linux.
+const soReusePort = 0xf
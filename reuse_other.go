@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package uhttp
+
+// setReuse does nothing on platforms where we don't know how to share ports.  Binding a port
+// already in use by another process will fail.
+func setReuse(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package uhttp
+
+import "syscall"
+
+// setReuse allows the socket fd to share its port with other sockets.  Windows has no
+// SO_REUSEPORT; SO_REUSEADDR has the same effect for UDP.
+func setReuse(fd uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
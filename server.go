@@ -0,0 +1,986 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by a Server's Serve methods after Shutdown or Close, and by its
+// ResponseWriter for responses that could not be sent because of Close.
+var ErrServerClosed = errors.New("uhttp: Server closed")
+
+// errNoHandler is returned by a Server's Serve methods if it has no Handler.
+var errNoHandler = errors.New("uhttp: Server.Handler is nil")
+
+// ErrResponseTooLarge is returned by a Server's ResponseWriter when a response body will not
+// fit in the space available.
+var ErrResponseTooLarge = errors.New("uhttp: response too large")
+
+// ResponseWriter is implemented by the http.ResponseWriter that a Server passes to its Handler.
+// A handler may use it to send several responses to one request, as an SSDP device answers a
+// single M-SEARCH with one response for each of its matching targets.
+//
+// Flush sends the response written so far as its own datagram, and starts a new, empty
+// response with an empty header, so that the handler can go on to write the next.  It does
+// nothing if nothing has been written since the last response.  FlushError is the same, but
+// reports a response that could not be sent, and is what http.ResponseController uses.
+type ResponseWriter interface {
+	http.ResponseWriter
+	http.Flusher
+	FlushError() error
+
+	// WriteResponse sends res as a response of its own, after first flushing any response the
+	// handler had been writing.  res.Body, if non-nil, is read and closed.
+	WriteResponse(res *http.Response) error
+}
+
+// Server responds to HTTP requests received over UDP.  Each request is passed to Handler in its
+// own goroutine, with at most MaxWorkers running at once.  Unlike net/http, a handler that neither calls WriteHeader nor Write sends no
+// response at all, which is usually what multicast protocols want from devices that have
+// nothing to say.  A handler may also send more than one response (see ResponseWriter).
+type Server struct {
+	// Addr is the UDP address to listen on, in the form "host:port".  If it names a multicast
+	// group, the server joins that group.
+	Addr string
+
+	// Handler is invoked for each request received.  It must be non-nil.  If it panics, the
+	// panic is logged and no further response is sent, as with net/http.
+	Handler http.Handler
+
+	// MaxWorkers is the maximum number of requests handled at once.  Once this many handlers are
+	// running, further packets are left unread until one finishes, and are dropped by the system
+	// if its receive buffer fills.  A zero value will use the default of 128.
+	MaxWorkers int
+
+	// Interface is the network interface on which to join the multicast group named by Addr.  A
+	// nil value lets the system choose.
+	Interface *net.Interface
+
+	// MaxSize is the maximum allowable size of an HTTP Request or Response.  It cannot be larger
+	// than 65507 (UDP limit).  A zero value will use the default of 8k.
+	MaxSize int
+
+	// Fragmentation enables the uhttp fragmentation extension.  Fragmented requests are
+	// reassembled before they are handled, and responses too large for a single datagram are
+	// fragmented, if the client has indicated that it can reassemble them.
+	Fragmentation bool
+
+	// MaxMessageSize is the maximum size of a fragmented request or response.  A zero value will
+	// use the default of 1MB.
+	MaxMessageSize int
+
+	// FragmentTimeout is how long to wait for the missing fragments of a request, and how long to
+	// keep the fragments of a response in case the client asks for some to be retransmitted.  A
+	// zero value will use the default of 2s.
+	FragmentTimeout time.Duration
+
+	// Compression enables Content-Encoding support.  Requests with a gzip or deflate
+	// Content-Encoding are decompressed before they are handled, and response bodies are
+	// compressed if the request's Accept-Encoding allows it and doing so makes them smaller.
+	Compression bool
+
+	// MaxDecompressedSize is the maximum size of a request body after decompression, and of a
+	// response body before compression.  A zero value will use the default of 1MB.
+	MaxDecompressedSize int
+
+	// RateLimit limits the rate, in packets per second, accepted from each source IP address,
+	// with bursts of up to RateBurst packets.  Packets arriving faster are dropped unread.  Each
+	// fragment of a fragmented request counts as a packet.  A zero value means no limit.
+	RateLimit float64
+	RateBurst int
+
+	// MaxAmplification limits the bytes sent in response to a request to this multiple of the
+	// request's size, so that the server is not useful for reflection attacks.  Responses that
+	// would exceed it are dropped.  A zero value means no limit.
+	MaxAmplification float64
+
+	// OnLinkOnly answers only senders in a subnet directly connected to this host.
+	//
+	// Regardless of this setting, requests from multicast and broadcast addresses are never
+	// answered.
+	OnLinkOnly bool
+
+	// ResponseDelay is how long to wait before each response to a request after the first, so
+	// that a burst of responses doesn't overrun the client's receive buffer.
+	ResponseDelay time.Duration
+
+	// Signer, if non-nil, verifies the signatures of requests and signs responses.  Requests
+	// that are unsigned or fail verification are dropped and counted in Metrics.  Since a
+	// fragmented request can only be verified once it is reassembled, senders that have not
+	// recently sent a valid request may have only one awaiting reassembly at a time, and
+	// only a few such senders may have one at once.
+	Signer *Signer
+
+	// Clock is used for fragment timeouts and response delays.  A nil value uses SystemClock.
+	Clock Clock
+
+	// Metrics, if non-nil, receives counters about the requests and responses handled.
+	Metrics Metrics
+
+	// Logger, if non-nil, records requests received, responses sent, and any problems with them.
+	Logger *slog.Logger
+
+	mu     sync.Mutex
+	reasm  *reassembler
+	sent   map[fragmentKey]*sentMessage
+	signed map[netip.Addr]time.Time // senders of validly signed requests, by when last seen
+
+	// Lifecycle state, created by init and guarded by mu.
+	conns      map[net.PacketConn]struct{}
+	listeners  map[net.Listener]struct{}
+	onShutdown []func(context.Context)
+	workers    chan struct{}
+	shutdown   chan struct{} // closed by Shutdown or Close
+	closed     chan struct{} // closed by Close
+	ctx        context.Context
+	cancel     context.CancelFunc
+	serving    sync.WaitGroup
+	hooks      sync.WaitGroup // functions from onShutdown still running
+}
+
+// defaultMaxWorkers is the default limit on the number of requests a Server handles at once.
+const defaultMaxWorkers = 128
+
+// sentMessage holds the fragments of a response, in case the client asks for some of them to
+// be retransmitted.
+type sentMessage struct {
+	frags   [][]byte
+	expires time.Time
+	budget  *byteBudget // of the request it answers
+}
+
+func (s *Server) clock() Clock {
+	if s.Clock != nil {
+		return s.Clock
+	}
+	return SystemClock
+}
+
+func (s *Server) metrics() Metrics {
+	if s.Metrics != nil {
+		return s.Metrics
+	}
+	return nopMetrics{}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+func (s *Server) maxSize() int {
+	if s.MaxSize > 0 {
+		return min(s.MaxSize, maxPacketSize)
+	}
+	return defaultPacketSize
+}
+
+func (s *Server) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+func (s *Server) maxDecompressedSize() int {
+	if s.MaxDecompressedSize > 0 {
+		return s.MaxDecompressedSize
+	}
+	return defaultMaxDecompressedSize
+}
+
+func (s *Server) fragmentTimeout() time.Duration {
+	if s.FragmentTimeout > 0 {
+		return s.FragmentTimeout
+	}
+	return defaultFragmentTimeout
+}
+
+// init creates the server's lifecycle state, if it hasn't been already.  s.mu must be held.
+func (s *Server) init() {
+	if s.shutdown != nil {
+		return
+	}
+	s.conns = make(map[net.PacketConn]struct{})
+	s.listeners = make(map[net.Listener]struct{})
+	n := s.MaxWorkers
+	if n <= 0 {
+		n = defaultMaxWorkers
+	}
+	s.workers = make(chan struct{}, n)
+	s.shutdown = make(chan struct{})
+	s.closed = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+}
+
+// lifecycle returns the server's worker pool, and the channels closed by Shutdown and Close.
+func (s *Server) lifecycle() (workers, shutdown, closed chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.workers, s.shutdown, s.closed
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// startServing records that a Serve method is running, so that Shutdown can wait for it to
+// return.  Returns false if the server is shutting down.
+func (s *Server) startServing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if isClosed(s.shutdown) {
+		return false
+	}
+	s.serving.Add(1)
+	return true
+}
+
+// trackConn adds conn to the sockets that Shutdown and Close stop, or removes it.  Returns false
+// if it can't be added because the server is shutting down.
+func (s *Server) trackConn(conn net.PacketConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if isClosed(s.shutdown) {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// trackListener adds l to the listeners that Shutdown and Close close, or removes it.  Returns
+// false if it can't be added because the server is shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if isClosed(s.shutdown) {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// RegisterOnShutdown registers f to be called, in its own goroutine, when Shutdown is called.
+// Serve methods keep their sockets open until every such f has returned, so this is where
+// anything built on the server can send its final announcements, such as an SSDP
+// ssdp:byebye, using the sockets from PacketConns.  ctx is the one given to Shutdown.
+func (s *Server) RegisterOnShutdown(f func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Shutdown gracefully stops the server.  It stops reading requests, calls the functions
+// registered with RegisterOnShutdown, and waits for them and for handlers already running,
+// including any delayed responses they are sending, to finish.  Each Serve method then closes
+// its sockets and returns ErrServerClosed.
+//
+// If ctx expires first, Shutdown calls Close and returns ctx.Err().  A server that has been
+// shut down cannot be used again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.init()
+	if !isClosed(s.shutdown) {
+		// Counted before closing shutdown, so that Serve methods see them when they stop.
+		s.hooks.Add(len(s.onShutdown))
+		close(s.shutdown)
+		for _, f := range s.onShutdown {
+			go func() {
+				defer s.hooks.Done()
+				f(ctx)
+			}()
+		}
+	}
+	conns, listeners := s.tracked()
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	// Unblock the reads without closing the sockets, which handlers may still be using.
+	for _, c := range conns {
+		if err := c.SetReadDeadline(time.Unix(1, 0)); err != nil {
+			c.Close()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.hooks.Wait()
+		s.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close immediately stops the server and closes its sockets.  The contexts of requests being
+// handled are canceled, and responses not yet sent fail with ErrServerClosed.  Serve methods
+// return ErrServerClosed.  Returns the first error from closing a socket or listener.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.init()
+	if !isClosed(s.shutdown) {
+		close(s.shutdown)
+	}
+	if !isClosed(s.closed) {
+		close(s.closed)
+	}
+	s.cancel()
+	conns, listeners := s.tracked()
+	s.mu.Unlock()
+
+	var err error
+	for _, l := range listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, c := range conns {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// waitHooks waits until the functions registered with RegisterOnShutdown have returned, if
+// Shutdown has called them, or until the server is closed.
+func (s *Server) waitHooks() {
+	_, shutdown, closed := s.lifecycle()
+	if !isClosed(shutdown) {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		s.hooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-closed:
+	}
+}
+
+// PacketConns returns the sockets being served, including the connections accepted by
+// ServeListener.  They stay open until the functions registered with RegisterOnShutdown
+// return, so those can use them to send final messages.
+func (s *Server) PacketConns() []net.PacketConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns, _ := s.tracked()
+	return conns
+}
+
+// tracked returns the sockets and listeners in use.  s.mu must be held.
+func (s *Server) tracked() ([]net.PacketConn, []net.Listener) {
+	var conns []net.PacketConn
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	var listeners []net.Listener
+	for l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	return conns, listeners
+}
+
+// reassembler returns the reassembler for fragmented requests.  s.mu must be held.
+func (s *Server) reassembler() *reassembler {
+	if s.reasm == nil {
+		s.reasm = newReassembler(s.maxMessageSize(), s.FragmentTimeout)
+	}
+	return s.reasm
+}
+
+// ListenAndServe listens on s.Addr and then calls Serve to handle requests.
+func (s *Server) ListenAndServe() error {
+	conn, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// listen opens a socket for s.Addr, joining its multicast group if it names one.
+func (s *Server) listen() (net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("uhttp: resolve %q: %v", s.Addr, err)
+	}
+	var conn net.PacketConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", s.Interface, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("uhttp: listen %q: %v", s.Addr, err)
+	}
+	return conn, nil
+}
+
+// Serve reads requests from conn and handles them, until reading from conn fails or the server
+// is shut down.  conn is closed before returning.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if s.Handler == nil {
+		conn.Close()
+		return errNoHandler
+	}
+	if !s.startServing() {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.serving.Done()
+	defer conn.Close()
+	if !s.trackConn(conn, true) {
+		return ErrServerClosed
+	}
+	defer s.trackConn(conn, false)
+	defer s.waitHooks()
+
+	done := make(chan struct{})
+	defer close(done)
+	if s.Fragmentation {
+		go s.pollFragments(func(b []byte, addr net.Addr) { writeTo(conn, b, addr) }, done)
+	}
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	return s.readPackets(conn, newSourceGuard(s), &handlers)
+}
+
+// ServeListener accepts connections from l and handles the requests received on each, until
+// accepting fails.  This allows requests to be served over connection-oriented datagram
+// protocols such as DTLS, where each connection carries the datagrams of one peer (see
+// package uhttpdtls).  l and any connections still open are closed before returning.
+func (s *Server) ServeListener(l net.Listener) error {
+	if s.Handler == nil {
+		l.Close()
+		return errNoHandler
+	}
+	if !s.startServing() {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.serving.Done()
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var mu sync.Mutex
+	conns := make(map[string]net.PacketConn)
+	closeConns := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	// Each connection's goroutine finishes once its reads stop and its handlers return.  When
+	// shutting down, reads have already been stopped, so let handlers finish with their
+	// connections still open.
+	var readers sync.WaitGroup
+	defer func() {
+		if _, shutdown, _ := s.lifecycle(); !isClosed(shutdown) {
+			closeConns()
+		}
+		readers.Wait()
+		closeConns()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	if s.Fragmentation {
+		go s.pollFragments(func(b []byte, addr net.Addr) {
+			mu.Lock()
+			c := conns[addr.String()]
+			mu.Unlock()
+			if c != nil {
+				c.WriteTo(b, addr)
+			}
+		}, done)
+	}
+
+	guard := newSourceGuard(s)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if _, shutdown, _ := s.lifecycle(); isClosed(shutdown) {
+				return ErrServerClosed
+			}
+			return err
+		}
+		pc := packetConn(c)
+		if !s.trackConn(pc, true) {
+			pc.Close()
+			return ErrServerClosed
+		}
+		key := c.RemoteAddr().String()
+		mu.Lock()
+		conns[key] = pc
+		mu.Unlock()
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			defer s.trackConn(pc, false)
+			var handlers sync.WaitGroup
+			s.readPackets(pc, guard, &handlers)
+			handlers.Wait()
+			s.waitHooks()
+			mu.Lock()
+			if conns[key] == pc {
+				delete(conns, key)
+			}
+			mu.Unlock()
+			pc.Close()
+		}()
+	}
+}
+
+// readPackets reads requests from conn and handles each in a goroutine from the worker pool,
+// tracked by handlers, until reading from conn fails or the server is shut down.
+func (s *Server) readPackets(conn net.PacketConn, guard *sourceGuard, handlers *sync.WaitGroup) error {
+	workers, shutdown, _ := s.lifecycle()
+	limit := s.maxSize()
+	buf := make([]byte, limit+1)
+	for {
+		n, sender, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isClosed(shutdown) {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.metrics().Add(MetricPacketsReceived, 1)
+		s.metrics().Add(MetricBytesReceived, int64(n))
+		if n > limit {
+			s.metrics().Add(MetricOversizeRequests, 1)
+			s.logger().Warn("uhttp: request too large", "sender", sender.String(), "limit", limit)
+			continue
+		}
+		if reason := guard.check(s.clock().Now(), sender); reason != "" {
+			if reason == refuseRate {
+				s.metrics().Add(MetricRateLimited, 1)
+			} else {
+				s.metrics().Add(MetricRefusedSources, 1)
+			}
+			s.logger().Debug("uhttp: request refused", "sender", sender.String(), "reason", reason)
+			continue
+		}
+		select {
+		case workers <- struct{}{}:
+		case <-shutdown:
+			return ErrServerClosed
+		}
+		handlers.Add(1)
+		go func(data []byte) {
+			defer handlers.Done()
+			defer func() { <-workers }()
+			s.handlePacket(conn, sender, data)
+		}(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// handlePacket parses the request in data and passes it to s.Handler.
+func (s *Server) handlePacket(conn net.PacketConn, sender net.Addr, data []byte) {
+	log := s.logger().With(slog.String("sender", sender.String()))
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		s.metrics().Add(MetricParseFailures, 1)
+		logPacket(context.Background(), log, slog.LevelWarn, "uhttp: parse request failed", sender, data, slog.Any("error", err))
+		return
+	}
+	req.RemoteAddr = sender.String()
+	s.mu.Lock()
+	req = req.WithContext(s.ctx)
+	s.mu.Unlock()
+	logPacket(req.Context(), log, slog.LevelDebug, "uhttp: request received", sender, data)
+
+	if s.Fragmentation {
+		if req.Method == resendMethod {
+			// Only responses to requests that passed verification are kept for resending.
+			s.resend(conn, sender, req, len(data), log)
+			return
+		}
+		if req, err = s.reassemble(conn, sender, req); err != nil {
+			log.Warn("uhttp: reassemble request failed", "error", err)
+			return
+		}
+		if req == nil {
+			return // waiting for more fragments
+		}
+	}
+	var nonce string
+	if s.Signer != nil {
+		if nonce, err = s.Signer.verifyRequest(req, s.maxMessageSize()); err != nil {
+			s.metrics().Add(MetricSignatureFailures, 1)
+			log.Warn("uhttp: request signature rejected", "error", err)
+			return
+		}
+		s.mu.Lock()
+		s.markSigned(s.clock().Now(), sender)
+		s.mu.Unlock()
+	}
+	if s.Compression {
+		body, n, ok, err := decodeBody(req.Header, req.Body, s.maxDecompressedSize())
+		if err != nil {
+			s.metrics().Add(MetricParseFailures, 1)
+			log.Warn("uhttp: decode request failed", "error", err)
+			return
+		}
+		if ok {
+			req.Body, req.ContentLength = body, n
+		}
+	}
+
+	reqSize := len(data)
+	if s.Fragmentation && req.ContentLength > 0 {
+		// Roughly account for the other fragments of a reassembled request.
+		reqSize = max(reqSize, len(data)+int(req.ContentLength))
+	}
+	w := &responseWriter{s: s, conn: conn, sender: sender, req: req, log: log, header: make(http.Header),
+		budget: s.responseBudget(reqSize), nonce: nonce}
+	defer func() {
+		if err := recover(); err != nil && err != http.ErrAbortHandler {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Error("uhttp: panic serving request", "error", err, "stack", string(buf))
+		}
+	}()
+	s.Handler.ServeHTTP(w, req)
+	w.finish()
+}
+
+// reassemble records req if it is a fragment.  Returns the reassembled request once all
+// fragments have arrived, or nil if more are needed.  Requests that are not fragmented are
+// returned as is.
+func (s *Server) reassemble(conn net.PacketConn, sender net.Addr, req *http.Request) (*http.Request, error) {
+	id, index, count, ok := parseFragment(req.Header)
+	if !ok {
+		return req, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	now := s.clock().Now()
+	head, full, err := s.reassembler().add(now, sender, s.trusted(now, sender), id, index, count, req, body)
+	s.mu.Unlock()
+	if head == nil || err != nil {
+		return nil, err
+	}
+	req = head.(*http.Request)
+	req.Body, req.ContentLength = stripFragmentHeaders(req.Header, full)
+	return req, nil
+}
+
+// resend retransmits the fragments of a response requested by the RESEND message req, which
+// was size bytes long.  Retransmissions are charged to the amplification budget of the original
+// request, which the RESEND itself adds to as any request would.
+func (s *Server) resend(conn net.PacketConn, sender net.Addr, req *http.Request, size int, log *slog.Logger) {
+	id, missing := parseResend(req)
+	s.mu.Lock()
+	m := s.sent[fragmentKey{sender.String(), id}]
+	if m != nil {
+		// Keep it around for as long as the client is still asking.
+		m.expires = s.clock().Now().Add(s.fragmentTimeout())
+	}
+	s.mu.Unlock()
+	if m == nil {
+		return
+	}
+
+	missing = slices.DeleteFunc(missing, func(i int) bool { return i < 0 || i >= len(m.frags) })
+	n := 0
+	for _, i := range missing {
+		n += len(m.frags[i])
+	}
+	if m.budget != nil {
+		m.budget.credit(int(s.MaxAmplification * float64(size)))
+	}
+	if !m.budget.spend(n) {
+		s.metrics().Add(MetricAmplificationLimited, 1)
+		log.Warn("uhttp: retransmission exceeds amplification limit", "bytes", n)
+		return
+	}
+	if err := resendFragments(conn, sender, m.frags, missing); err == nil {
+		s.metrics().Add(MetricBytesSent, int64(n))
+	}
+}
+
+// pollFragments periodically asks clients for fragments of requests that have gone missing,
+// and forgets about responses that are too old to be retransmitted, until done is closed.
+// Requests for fragments are sent with write.
+func (s *Server) pollFragments(write func(b []byte, addr net.Addr), done <-chan struct{}) {
+	s.mu.Lock()
+	interval := s.reassembler().interval()
+	s.mu.Unlock()
+	for {
+		timer := s.clock().NewTimer(interval)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		now := s.clock().Now()
+		s.mu.Lock()
+		resends, _ := s.reassembler().poll(now)
+		for k, m := range s.sent {
+			if now.After(m.expires) {
+				delete(s.sent, k)
+			}
+		}
+		s.mu.Unlock()
+		for _, rr := range resends {
+			write(newResend(rr.id, rr.missing), rr.sender)
+		}
+	}
+}
+
+// send writes the response in data to the sender of req.  If it is too large for a single
+// datagram, it is fragmented if possible, and otherwise dropped.  The bytes sent, including the
+// headers of any fragments, are charged to budget, and the response is dropped if they would
+// exceed it.
+func (s *Server) send(conn net.PacketConn, sender net.Addr, req *http.Request, data []byte, budget *byteBudget, log *slog.Logger) (err error) {
+	limit := s.maxSize()
+	accept, _ := strconv.Atoi(req.Header.Get(acceptFragmentsHeader))
+	if accept > 0 {
+		limit = min(limit, accept)
+	}
+
+	packets := [][]byte{data}
+	if len(data) > limit {
+		if !s.Fragmentation || accept <= 0 {
+			s.metrics().Add(MetricOversizeResponses, 1)
+			log.Warn("uhttp: response too large", "bytes", len(data), "limit", limit)
+			return ErrResponseTooLarge
+		}
+		id := newMessageID()
+		var frags [][]byte
+		if frags, err = splitMessage(data, id, limit); err != nil {
+			return err
+		}
+		packets = frags
+		defer func() {
+			if err == nil {
+				s.mu.Lock()
+				if s.sent == nil {
+					s.sent = make(map[fragmentKey]*sentMessage)
+				}
+				s.sent[fragmentKey{sender.String(), id}] = &sentMessage{frags, s.clock().Now().Add(s.fragmentTimeout()), budget}
+				s.mu.Unlock()
+			}
+		}()
+	}
+
+	size := 0
+	for _, p := range packets {
+		size += len(p)
+	}
+	if !budget.spend(size) {
+		s.metrics().Add(MetricAmplificationLimited, 1)
+		log.Warn("uhttp: response exceeds amplification limit", "bytes", size)
+		return fmt.Errorf("%w: amplification limit", ErrResponseTooLarge)
+	}
+
+	n, err := writePackets(func(b []byte) (int, error) { return conn.WriteTo(b, sender) }, packets)
+	if err != nil {
+		log.Warn("uhttp: send response failed", "error", err)
+		return err
+	}
+	s.metrics().Add(MetricResponsesSent, 1)
+	s.metrics().Add(MetricBytesSent, int64(n))
+	log.Debug("uhttp: response sent", "bytes", n, "packets", len(packets))
+	return nil
+}
+
+// responseWriter is the ResponseWriter given to a Server's Handler.  Each response is buffered
+// until the handler flushes it or returns, and then sent as a datagram.
+type responseWriter struct {
+	s      *Server
+	conn   net.PacketConn
+	sender net.Addr
+	req    *http.Request
+	log    *slog.Logger
+
+	header http.Header
+	status int
+	body   bytes.Buffer
+
+	// sent is the number of responses sent so far.
+	sent int
+
+	// budget limits the bytes sent in response, or is nil if unlimited.
+	budget *byteBudget
+
+	// nonce is that of the request's signature, if it was signed.
+	nonce string
+}
+
+var _ ResponseWriter = (*responseWriter)(nil)
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// Write adds b to the response body.  Returns ErrResponseTooLarge if the body would no longer
+// fit in a response.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	limit := w.s.maxSize()
+	if w.s.Fragmentation {
+		limit = w.s.maxMessageSize()
+	}
+	if w.s.Compression {
+		// It may yet compress to fit.
+		limit = max(limit, w.s.maxDecompressedSize())
+	}
+	if w.body.Len()+len(b) > limit {
+		return 0, ErrResponseTooLarge
+	}
+	return w.body.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// FlushError sends the response written so far, if any, and starts a new one.
+func (w *responseWriter) FlushError() error {
+	if w.status == 0 {
+		return nil
+	}
+	err := w.send()
+	w.header = make(http.Header)
+	w.status = 0
+	w.body.Reset()
+	return err
+}
+
+func (w *responseWriter) WriteResponse(res *http.Response) error {
+	if err := w.FlushError(); err != nil {
+		return err
+	}
+	w.status = res.StatusCode
+	if res.Header != nil {
+		w.header = res.Header.Clone()
+	}
+	if res.Body != nil {
+		defer res.Body.Close()
+		if _, err := io.Copy(w, res.Body); err != nil {
+			w.header = make(http.Header)
+			w.status = 0
+			w.body.Reset()
+			return err
+		}
+	}
+	return w.FlushError()
+}
+
+// finish sends the last response, if the handler wrote one.
+func (w *responseWriter) finish() {
+	w.FlushError()
+}
+
+// send sends the current response, after waiting s.ResponseDelay if it isn't the first.
+func (w *responseWriter) send() error {
+	if w.s.Compression {
+		w.compress()
+	}
+	if w.s.Signer != nil {
+		w.s.Signer.signResponse(w.status, w.header, w.body.Bytes(), w.nonce)
+	}
+	res := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          io.NopCloser(&w.body),
+	}
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		w.log.Warn("uhttp: write response failed", "error", err)
+		return err
+	}
+	if w.sent > 0 && w.s.ResponseDelay > 0 {
+		_, _, closed := w.s.lifecycle()
+		timer := w.s.clock().NewTimer(w.s.ResponseDelay)
+		select {
+		case <-timer.C():
+		case <-closed:
+			timer.Stop()
+			return ErrServerClosed
+		}
+	}
+	w.sent++
+	return w.s.send(w.conn, w.sender, w.req, buf.Bytes(), w.budget, w.log)
+}
+
+// compress replaces the response body with a compressed one, if the request allows it and the
+// result is smaller.
+func (w *responseWriter) compress() {
+	if w.body.Len() == 0 || w.header.Get("Content-Encoding") != "" {
+		return
+	}
+	enc := negotiateEncoding(w.req.Header.Get("Accept-Encoding"))
+	if enc == "" {
+		return
+	}
+	w.header.Add("Vary", "Accept-Encoding")
+	b, err := compressBody(enc, w.body.Bytes())
+	if err != nil || len(b) >= w.body.Len() {
+		return
+	}
+	w.header.Set("Content-Encoding", enc)
+	w.body.Reset()
+	w.body.Write(b)
+}
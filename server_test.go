@@ -0,0 +1,738 @@
+package uhttp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnesting/uhttp"
+)
+
+// serve starts s on a loopback socket, wrapped by wrap if non-nil, and returns its address.
+func serve(t *testing.T, s *uhttp.Server, wrap func(net.PacketConn) net.PacketConn) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	if wrap != nil {
+		conn = wrap(conn)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(conn)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return addr
+}
+
+func TestServer(t *testing.T) {
+	addr := serve(t, &uhttp.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("St") == "ignore" {
+			return
+		}
+		w.Header().Set("Ext", "")
+		io.WriteString(w, "hello "+r.Method)
+	})}, nil)
+
+	c := uhttp.Client{Transport: &uhttp.Transport{}}
+	req, _ := http.NewRequest("M-SEARCH", "http://"+addr+"/", nil)
+	var got []string
+	err := c.Do(req, 500*time.Millisecond, func(sender net.Addr, res *http.Response) error {
+		b, _ := io.ReadAll(res.Body)
+		got = append(got, string(b))
+		return uhttp.Stop
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "hello M-SEARCH" {
+		t.Errorf("responses = %q", got)
+	}
+
+	// A handler that writes nothing sends nothing.
+	req, _ = http.NewRequest("M-SEARCH", "http://"+addr+"/", nil)
+	req.Header.Set("ST", "ignore")
+	n := 0
+	err = c.Do(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("got %d responses, want 0", n)
+	}
+}
+
+// lossyConn drops the first datagram in each direction that carries each of the listed
+// Uhttp-Fragment values.
+type lossyConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	dropIn  map[string]bool
+	dropOut map[string]bool
+}
+
+var fragmentRE = regexp.MustCompile(`(?i)\r\nUhttp-Fragment: ([0-9/]+)\r\n`)
+
+func (c *lossyConn) drop(set map[string]bool, b []byte) bool {
+	m := fragmentRE.FindSubmatch(b)
+	if m == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if set[string(m[1])] {
+		delete(set, string(m[1]))
+		return true
+	}
+	return false
+}
+
+func (c *lossyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.drop(c.dropIn, b[:n]) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.drop(c.dropOut, b) {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestServerFragmentation(t *testing.T) {
+	reqBody := bytes.Repeat([]byte("request "), 100*1024/8)
+	resBody := bytes.Repeat([]byte("response"), 200*1024/8)
+
+	s := &uhttp.Server{
+		Fragmentation:   true,
+		FragmentTimeout: 2 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			if !bytes.Equal(b, reqBody) {
+				t.Errorf("server got %d byte body, want %d", len(b), len(reqBody))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write(resBody)
+		}),
+	}
+	lossy := &lossyConn{
+		dropIn:  map[string]bool{"3/13": true},
+		dropOut: map[string]bool{"2/26": true, "25/26": true},
+	}
+	addr := serve(t, s, func(c net.PacketConn) net.PacketConn {
+		lossy.PacketConn = c
+		return lossy
+	})
+
+	tr := &uhttp.Transport{Fragmentation: true, FragmentTimeout: 2 * time.Second}
+	req, _ := http.NewRequest("POST", "http://"+addr+"/sync", bytes.NewReader(reqBody))
+	var got []byte
+	err := tr.RoundTripMulti(req, 5*time.Second, func(sender net.Addr, res *http.Response) error {
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("status = %d", res.StatusCode)
+		}
+		if res.Header.Get("Uhttp-Fragment") != "" {
+			t.Error("fragment header leaked into reassembled response")
+		}
+		got, _ = io.ReadAll(res.Body)
+		return uhttp.Stop
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, resBody) {
+		t.Errorf("client got %d byte body, want %d", len(got), len(resBody))
+	}
+	lossy.mu.Lock()
+	defer lossy.mu.Unlock()
+	if len(lossy.dropIn) != 0 || len(lossy.dropOut) != 0 {
+		t.Errorf("fragments not dropped: %v %v", lossy.dropIn, lossy.dropOut)
+	}
+}
+
+func TestServerResponseTooLarge(t *testing.T) {
+	s := &uhttp.Server{
+		MaxSize: 1024,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := w.Write(make([]byte, 2048)); err != uhttp.ErrResponseTooLarge {
+				t.Errorf("Write = %v, want ErrResponseTooLarge", err)
+			}
+		}),
+	}
+	addr := serve(t, s, nil)
+	tr := &uhttp.Transport{}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	var lengths []int64
+	if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(_ net.Addr, res *http.Response) error {
+		lengths = append(lengths, res.ContentLength)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The status was committed by the first Write, so an empty response is still sent.
+	if len(lengths) != 1 || lengths[0] != 0 {
+		t.Errorf("got responses with lengths %v, want [0]", lengths)
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	reqBody := bytes.Repeat([]byte(`{"config":"value"}`), 1000)
+	resBody := bytes.Repeat([]byte(`{"status":"ok"}`), 2000)
+	addr := serve(t, &uhttp.Server{
+		Compression: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			if !bytes.Equal(b, reqBody) {
+				t.Errorf("server got %d byte body, want %d", len(b), len(reqBody))
+			}
+			w.Write(resBody)
+		}),
+	}, nil)
+
+	tr := &uhttp.Transport{Compression: true, RequestEncoding: "deflate"}
+	req, _ := http.NewRequest("POST", "http://"+addr+"/", bytes.NewReader(reqBody))
+	var got []byte
+	err := tr.RoundTripMulti(req, time.Second, func(_ net.Addr, res *http.Response) error {
+		if !res.Uncompressed || res.Header.Get("Content-Encoding") != "" {
+			t.Errorf("response not decompressed: %v", res.Header)
+		}
+		got, _ = io.ReadAll(res.Body)
+		return uhttp.Stop
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, resBody) {
+		t.Errorf("client got %d byte body, want %d", len(got), len(resBody))
+	}
+}
+
+func TestServerAmplification(t *testing.T) {
+	m := &uhttp.MemoryMetrics{}
+	addr := serve(t, &uhttp.Server{
+		MaxAmplification: 3,
+		Metrics:          m,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := strconv.Atoi(r.Header.Get("X-Size"))
+			w.Write(bytes.Repeat([]byte("x"), n))
+		}),
+	}, nil)
+
+	tr := &uhttp.Transport{}
+	for _, tc := range []struct {
+		size string
+		want int
+	}{{"10", 1}, {"2000", 0}} {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		req.Header.Set("X-Size", tc.size)
+		n := 0
+		if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.want {
+			t.Errorf("size %s: got %d responses, want %d", tc.size, n, tc.want)
+		}
+	}
+	if got := m.Snapshot().Counters[uhttp.MetricAmplificationLimited]; got != 1 {
+		t.Errorf("%s = %d, want 1", uhttp.MetricAmplificationLimited, got)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	m := &uhttp.MemoryMetrics{}
+	addr := serve(t, &uhttp.Server{
+		RateLimit: 0.001,
+		RateBurst: 2,
+		Metrics:   m,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+	}, nil)
+
+	tr := &uhttp.Transport{Repeat: uhttp.RepeatAfter(time.Millisecond, 4)}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	n := 0
+	if err := tr.RoundTripMulti(req, 300*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d responses, want 2", n)
+	}
+	if got := m.Snapshot().Counters[uhttp.MetricRateLimited]; got != 3 {
+		t.Errorf("%s = %d, want 3", uhttp.MetricRateLimited, got)
+	}
+}
+
+func TestServerSigned(t *testing.T) {
+	key := []byte("fleet secret")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	signed := serve(t, &uhttp.Server{Signer: uhttp.NewSigner("k1", key), Handler: handler}, nil)
+	unsigned := serve(t, &uhttp.Server{Handler: handler}, nil)
+
+	for _, tc := range []struct {
+		desc     string
+		addr     string
+		key      []byte
+		want     int
+		rejected int
+	}{
+		{"same key", signed, key, 1, 0},
+		{"wrong key", signed, []byte("other"), 0, 0},
+		{"unsigned server", unsigned, key, 0, 1},
+	} {
+		var rejected int
+		ctx := uhttp.WithClientTrace(context.Background(), &uhttp.ClientTrace{
+			PacketRejected: func(_ net.Addr, reason uhttp.RejectReason) {
+				if reason == uhttp.RejectBadSignature {
+					rejected++
+				}
+			},
+		})
+		tr := &uhttp.Transport{Signer: uhttp.NewSigner("k1", tc.key)}
+		req, _ := http.NewRequestWithContext(ctx, "M-SEARCH", "http://"+tc.addr+"/", nil)
+		n := 0
+		if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+			n++
+			return nil
+		}); err != nil && tc.rejected == 0 {
+			t.Errorf("%s: %v", tc.desc, err)
+		}
+		if n != tc.want || rejected != tc.rejected {
+			t.Errorf("%s: got %d responses and %d rejected, want %d and %d", tc.desc, n, rejected, tc.want, tc.rejected)
+		}
+	}
+}
+
+func TestServerMultipleResponses(t *testing.T) {
+	m := &uhttp.MemoryMetrics{}
+	errs := make(chan error, 1)
+	addr := serve(t, &uhttp.Server{
+		MaxSize:       512,
+		ResponseDelay: 20 * time.Millisecond,
+		Metrics:       m,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uw := w.(uhttp.ResponseWriter)
+			w.Header().Set("St", "upnp:rootdevice")
+			w.Header().Set("X-First", "1")
+			w.WriteHeader(http.StatusOK)
+			uw.Flush()
+
+			w.Header().Set("St", "uuid:1234")
+			w.WriteHeader(http.StatusOK)
+			http.NewResponseController(w).Flush()
+
+			// Nothing was written, so there's nothing to send.
+			uw.Flush()
+
+			// Too large for a single datagram; dropped without affecting the others.
+			w.Header().Set("St", "too-large")
+			w.Write(make([]byte, 500))
+			err := uw.FlushError()
+
+			uw.WriteResponse(&http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"St": {"urn:schemas-upnp-org:device:Basic:1"}},
+				Body:       io.NopCloser(bytes.NewReader([]byte("body"))),
+			})
+
+			// Sent when the handler returns.
+			w.Header().Set("St", "urn:schemas-upnp-org:service:Dummy:1")
+			w.WriteHeader(http.StatusOK)
+			errs <- err
+		}),
+	}, nil)
+
+	tr := &uhttp.Transport{}
+	req, _ := http.NewRequest("M-SEARCH", "http://"+addr+"/", nil)
+	var sts, bodies []string
+	var times []time.Time
+	if err := tr.RoundTripMulti(req, 500*time.Millisecond, func(_ net.Addr, res *http.Response) error {
+		b, _ := io.ReadAll(res.Body)
+		if len(sts) > 0 && res.Header.Get("X-First") != "" {
+			t.Errorf("header of the first response carried over to %q", res.Header.Get("St"))
+		}
+		sts = append(sts, res.Header.Get("St"))
+		bodies = append(bodies, string(b))
+		times = append(times, time.Now())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, uhttp.ErrResponseTooLarge) {
+		t.Errorf("FlushError = %v, want ErrResponseTooLarge", err)
+	}
+
+	want := []string{"upnp:rootdevice", "uuid:1234", "urn:schemas-upnp-org:device:Basic:1", "urn:schemas-upnp-org:service:Dummy:1"}
+	if !slices.Equal(sts, want) {
+		t.Fatalf("got responses for %q, want %q", sts, want)
+	}
+	if bodies[2] != "body" {
+		t.Errorf("WriteResponse body = %q, want %q", bodies[2], "body")
+	}
+	// Three delays were taken: before the too-large response and the two after it.
+	if d := times[3].Sub(times[0]); d < 60*time.Millisecond {
+		t.Errorf("responses arrived within %v, want at least 60ms", d)
+	}
+	if got := m.Snapshot().Counters[uhttp.MetricResponsesSent]; got != 4 {
+		t.Errorf("%s = %d, want 4", uhttp.MetricResponsesSent, got)
+	}
+}
+
+func TestServerMultipleResponsesAmplification(t *testing.T) {
+	errs := make(chan error, 3)
+	addr := serve(t, &uhttp.Server{
+		MaxAmplification: 3,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for range 3 {
+				w.Write(bytes.Repeat([]byte("x"), 80))
+				errs <- w.(uhttp.ResponseWriter).FlushError()
+			}
+		}),
+	}, nil)
+
+	tr := &uhttp.Transport{}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	n := 0
+	if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The request is about 50 bytes, so only one of the ~120-byte responses fits in the budget.
+	if n != 1 {
+		t.Errorf("got %d responses, want 1", n)
+	}
+	for i := range 3 {
+		err := <-errs
+		if (i == 0) != (err == nil) {
+			t.Errorf("response %d: FlushError = %v", i, err)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &uhttp.Server{
+		ResponseDelay: 50 * time.Millisecond,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			for _, st := range []string{"a", "b"} {
+				w.Header().Set("St", st)
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+			}
+		}),
+	}
+	var byebye []string
+	s.RegisterOnShutdown(func(context.Context) {
+		// The socket is still usable for final announcements.
+		if _, err := conn.WriteTo([]byte("byebye"), conn.LocalAddr()); err != nil {
+			byebye = append(byebye, err.Error())
+		} else {
+			byebye = append(byebye, "sent")
+		}
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+
+	var sts []string
+	got := make(chan struct{})
+	go func() {
+		defer close(got)
+		tr := &uhttp.Transport{}
+		req, _ := http.NewRequest("M-SEARCH", "http://"+addr+"/", nil)
+		tr.RoundTripMulti(req, time.Second, func(_ net.Addr, res *http.Response) error {
+			sts = append(sts, res.Header.Get("St"))
+			if len(sts) == 2 {
+				return uhttp.Stop
+			}
+			return nil
+		})
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a handler still running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if err := <-served; err != uhttp.ErrServerClosed {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+	<-got
+	if !slices.Equal(sts, []string{"a", "b"}) {
+		t.Errorf("responses = %q, want both delayed responses", sts)
+	}
+	if !slices.Equal(byebye, []string{"sent"}) {
+		t.Errorf("shutdown hook = %q", byebye)
+	}
+	if _, err := conn.WriteTo([]byte("x"), conn.LocalAddr()); err == nil {
+		t.Error("socket still open after Shutdown")
+	}
+	if err := s.Serve(conn); err != uhttp.ErrServerClosed {
+		t.Errorf("Serve after Shutdown = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	started := make(chan struct{})
+	errs := make(chan error, 1)
+	s := &uhttp.Server{
+		ResponseDelay: time.Hour,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			close(started)
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusOK)
+			errs <- w.(uhttp.ResponseWriter).FlushError()
+		}),
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+
+	tr := &uhttp.Transport{}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	go tr.RoundTripMulti(req, time.Second, func(net.Addr, *http.Response) error { return uhttp.Stop })
+	<-started
+
+	// Shutdown gives up waiting for the handler and closes the server.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+	if err := <-errs; err != uhttp.ErrServerClosed {
+		t.Errorf("delayed response after Close = %v, want ErrServerClosed", err)
+	}
+	if err := <-served; err != uhttp.ErrServerClosed {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerShutdownHookSends(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	s := &uhttp.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+	release := make(chan struct{})
+	hookErr := make(chan error, 1)
+	s.RegisterOnShutdown(func(context.Context) {
+		<-release
+		conns := s.PacketConns()
+		if len(conns) != 1 {
+			hookErr <- errors.New("no socket to send on")
+			return
+		}
+		_, err := conns[0].WriteTo([]byte("byebye"), peer.LocalAddr())
+		hookErr <- err
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+	for len(s.PacketConns()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	// Serve has no handlers to wait for, but must keep its socket open for the hook.
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned %v with a shutdown hook still running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-hookErr; err != nil {
+		t.Errorf("hook send = %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	if n, _, err := peer.ReadFrom(buf); err != nil || string(buf[:n]) != "byebye" {
+		t.Errorf("peer got %q, %v", buf[:n], err)
+	}
+	if err := <-served; err != uhttp.ErrServerClosed {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+	if _, err := conn.WriteTo([]byte("x"), peer.LocalAddr()); err == nil {
+		t.Error("socket still open after Serve returned")
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	var logs bytes.Buffer
+	var mu sync.Mutex
+	addr := serve(t, &uhttp.Server{
+		MaxWorkers: 1,
+		Logger:     slog.New(slog.NewTextHandler(&lockedWriter{w: &logs, mu: &mu}, nil)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/panic" {
+				panic("boom")
+			}
+			io.WriteString(w, "ok")
+		}),
+	}, nil)
+
+	tr := &uhttp.Transport{}
+	// With only one worker, the second request is handled only if the panic freed it.
+	for _, tc := range []struct {
+		path string
+		want int
+	}{{"/panic", 0}, {"/", 1}} {
+		req, _ := http.NewRequest("GET", "http://"+addr+tc.path, nil)
+		n := 0
+		if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+			n++
+			return uhttp.Stop
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.want {
+			t.Errorf("%s: got %d responses, want %d", tc.path, n, tc.want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(logs.String(), "panic serving request") || !strings.Contains(logs.String(), "boom") {
+		t.Errorf("panic not logged: %s", logs.String())
+	}
+}
+
+// lockedWriter serializes writes to w.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+func TestServerNilHandler(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&uhttp.Server{}).Serve(conn); err == nil {
+		t.Error("Serve with a nil Handler succeeded")
+	}
+	if _, err := conn.WriteTo([]byte("x"), conn.LocalAddr()); err == nil {
+		t.Error("socket still open after Serve returned")
+	}
+}
+
+func TestServerMaxWorkers(t *testing.T) {
+	var mu sync.Mutex
+	running, peak, handled := 0, 0, 0
+	release := make(chan struct{})
+	addr := serve(t, &uhttp.Server{
+		MaxWorkers: 2,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			running--
+			handled++
+			mu.Unlock()
+		}),
+	}, nil)
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for range 5 {
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if running != 2 {
+		t.Errorf("%d handlers running, want 2", running)
+	}
+	mu.Unlock()
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n, p := handled, peak
+		mu.Unlock()
+		if n == 5 {
+			if p != 2 {
+				t.Errorf("peak of %d handlers running, want 2", p)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %d requests, want 5", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,517 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSessionClosed is returned by calls on a Session that has been closed.
+var ErrSessionClosed = errors.New("uhttp: session closed")
+
+// sessionQueueLen is the number of responses that may be queued for an in-flight request before
+// further responses to it are dropped.
+const sessionQueueLen = 64
+
+// A Correlator decides whether a response received by a Session answers an in-flight request.
+// dest is the address req was sent to.  A response may match more than one request.
+type Correlator interface {
+	Match(req *http.Request, dest, sender net.Addr, res *http.Response) bool
+}
+
+// CorrelatorFunc implements Correlator with a function.
+type CorrelatorFunc func(req *http.Request, dest, sender net.Addr, res *http.Response) bool
+
+func (f CorrelatorFunc) Match(req *http.Request, dest, sender net.Addr, res *http.Response) bool {
+	return f(req, dest, sender, res)
+}
+
+// BySender matches responses to unicast requests by the address they were sent to.  Requests
+// sent to a multicast or broadcast address match responses from any sender.
+var BySender Correlator = CorrelatorFunc(func(_ *http.Request, dest, sender net.Addr, _ *http.Response) bool {
+	d, ok := dest.(*net.UDPAddr)
+	if !ok {
+		return dest.String() == sender.String()
+	}
+	if d.IP.Equal(net.IPv4bcast) || d.IP.IsMulticast() {
+		return true
+	}
+	s, ok := sender.(*net.UDPAddr)
+	return ok && d.IP.Equal(s.IP) && d.Port == s.Port
+})
+
+// requestHeader returns the value of the header name as sent with req, which comes from the
+// OrderedHeader in its context if there is one.
+func requestHeader(req *http.Request, name string) string {
+	if oh := ContextOrderedHeader(req.Context()); oh != nil {
+		return oh.Get(name)
+	}
+	return req.Header.Get(name)
+}
+
+// ByHeader returns a Correlator that matches responses whose header name has the same value as
+// the request's, such as a transaction ID the responder echoes back.  Requests without the
+// header match nothing.
+func ByHeader(name string) Correlator {
+	return CorrelatorFunc(func(req *http.Request, _, _ net.Addr, res *http.Response) bool {
+		v := requestHeader(req, name)
+		return v != "" && strings.EqualFold(v, res.Header.Get(name))
+	})
+}
+
+// ByST matches SSDP search responses to the M-SEARCH whose ST they answer.  A search for
+// ssdp:all matches any response carrying an ST.
+var ByST Correlator = CorrelatorFunc(func(req *http.Request, _, _ net.Addr, res *http.Response) bool {
+	st, got := requestHeader(req, "St"), res.Header.Get("St")
+	if st == "" || got == "" {
+		return false
+	}
+	return st == "ssdp:all" || strings.EqualFold(st, got)
+})
+
+// UnmatchedPolicy describes what a Session does with a response that matches no in-flight
+// request.
+type UnmatchedPolicy int
+
+const (
+	// DropUnmatched discards the response.
+	DropUnmatched UnmatchedPolicy = iota
+
+	// DeliverUnmatched delivers the response to every in-flight request.
+	DeliverUnmatched
+
+	// HandleUnmatched passes the response to Session.UnmatchedHandler.
+	HandleUnmatched
+)
+
+// Session issues requests from a single long-lived UDP socket, allowing many requests to be in
+// flight at once.  Each response received is delivered to the in-flight requests it matches, as
+// decided by Correlate.  A Session implements RoundTripMultier, so it may be used anywhere a
+// Transport is.
+//
+// The socket is opened on first use and remains open until Close is called.  It is bound to
+// Transport.LocalAddr if that is set.  If Transport.DialContext is set instead, unicast
+// requests are sent over a connection dialed once for each destination and kept open
+// alongside the socket.  Requests are serialized and responses parsed according to Transport,
+// though a Session does not support fragmentation, and never offers to reassemble fragmented
+// responses.
+type Session struct {
+	// Transport provides the settings used to send requests and receive responses.  A nil
+	// value uses a zero Transport.
+	Transport *Transport
+
+	// Correlate decides which in-flight requests a response answers.  A nil value uses
+	// BySender.
+	Correlate Correlator
+
+	// Unmatched says what to do with responses that match no in-flight request.
+	Unmatched UnmatchedPolicy
+
+	// UnmatchedHandler receives unmatched responses if Unmatched is HandleUnmatched.  It is
+	// called from the goroutine reading the socket, so it should return promptly.
+	UnmatchedHandler func(sender net.Addr, res *http.Response)
+
+	mu      sync.Mutex
+	conn    net.PacketConn
+	dialed  map[string]net.PacketConn // by destination, with Transport.DialContext
+	calls   map[*sessionCall]struct{}
+	done    chan struct{} // closed when the socket is no longer being read
+	doneErr error
+	closed  bool // set by Close
+}
+
+// sessionCall is a request in flight on a Session.
+type sessionCall struct {
+	req  *http.Request
+	dest *net.UDPAddr
+	ch   chan sessionPacket
+}
+
+type sessionPacket struct {
+	addr    net.Addr
+	ifIndex int // of the receiving interface, or 0 if unknown
+	data    []byte
+}
+
+var zeroTransport = &Transport{}
+
+func (s *Session) transport() *Transport {
+	if s.Transport != nil {
+		return s.Transport
+	}
+	return zeroTransport
+}
+
+func (s *Session) correlate() Correlator {
+	if s.Correlate != nil {
+		return s.Correlate
+	}
+	return BySender
+}
+
+// open returns the session's socket, opening it if necessary.
+func (s *Session) open() (net.PacketConn, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done != nil {
+		select {
+		case <-s.done:
+			return nil, nil, s.doneErr
+		default:
+			return s.conn, s.done, nil
+		}
+	}
+	t := s.transport()
+	var conn net.PacketConn
+	var err error
+	if t.LocalAddr != "" {
+		conn, err = listenShared(t.LocalAddr)
+	} else {
+		conn, err = net.ListenPacket("udp", "")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("uhttp: listen: %v", err)
+	}
+	s.conn = conn
+	s.dialed = make(map[string]net.PacketConn)
+	s.calls = make(map[*sessionCall]struct{})
+	s.done = make(chan struct{})
+	t.logger().Debug("uhttp: socket opened", "local", conn.LocalAddr().String())
+	go s.read(conn, t.reader(conn), true)
+	return conn, s.done, nil
+}
+
+// dial returns the connection to raddr opened with Transport.DialContext, dialing it if
+// necessary.
+func (s *Session) dial(ctx context.Context, raddr *net.UDPAddr) (net.PacketConn, error) {
+	key := raddr.String()
+	s.mu.Lock()
+	conn := s.dialed[key]
+	s.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	c, err := s.transport().DialContext(ctx, "udp", key)
+	if err != nil {
+		return nil, fmt.Errorf("uhttp: dial %q: %v", key, err)
+	}
+	conn = packetConn(c)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrSessionClosed, net.ErrClosed)
+	}
+	if existing := s.dialed[key]; existing != nil {
+		// Another call got there first.
+		conn.Close()
+		return existing, nil
+	}
+	s.dialed[key] = conn
+	s.transport().logger().Debug("uhttp: connection opened", "local", conn.LocalAddr().String(), "dest", key)
+	go s.read(conn, s.transport().reader(conn), false)
+	return conn, nil
+}
+
+// Close closes the session's socket.  In-flight requests return ErrSessionClosed.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.done == nil {
+		// Never opened; make sure it never will be.
+		s.done = make(chan struct{})
+		s.doneErr = ErrSessionClosed
+		close(s.done)
+		s.mu.Unlock()
+		return nil
+	}
+	conn := s.conn
+	dialed := s.dialed
+	s.dialed = nil
+	s.mu.Unlock()
+	for _, c := range dialed {
+		c.Close()
+	}
+	return conn.Close()
+}
+
+// read delivers packets received on conn, using readFrom, to the calls they match, until conn
+// is closed.  If conn is the session's main socket, the session ends with it; a dialed connection is just
+// forgotten, to be dialed again if needed.
+func (s *Session) read(conn net.PacketConn, readFrom ifaceReader, main bool) {
+	t := s.transport()
+	metrics := t.metrics()
+	log := t.logger()
+	limit := t.maxResponseSize()
+	b := make([]byte, limit+1)
+	for {
+		n, ifIndex, addr, err := readFrom(b)
+		if err != nil {
+			s.mu.Lock()
+			if !main {
+				for k, c := range s.dialed {
+					if c == conn {
+						delete(s.dialed, k)
+					}
+				}
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.doneErr = ErrSessionClosed
+			if !errors.Is(err, net.ErrClosed) {
+				s.doneErr = fmt.Errorf("uhttp: session read: %w", err)
+			}
+			close(s.done)
+			s.mu.Unlock()
+			return
+		}
+		metrics.Add(MetricPacketsReceived, 1)
+		metrics.Add(MetricBytesReceived, int64(n))
+		if n > limit {
+			metrics.Add(MetricTruncated, 1)
+			log.Warn("uhttp: response truncated", "sender", addr.String(), "limit", limit)
+			continue
+		}
+		data := append([]byte(nil), b[:n]...)
+		logPacket(context.Background(), log, slog.LevelDebug, "uhttp: packet received", addr, data)
+
+		// Parse the headers now so that we can tell who the response is for.  Each matching call
+		// parses it again for itself, since each needs its own body and Request.
+		parsed := data
+		if t.LenientParsing {
+			if normalized, q := normalizeResponse(data); q != 0 {
+				parsed = normalized
+			}
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(parsed)), nil)
+		if err != nil {
+			metrics.Add(MetricParseFailures, 1)
+			logPacket(context.Background(), log, slog.LevelWarn, "uhttp: parse response failed", addr, data, slog.Any("error", err))
+			continue
+		}
+		s.deliver(sessionPacket{addr, ifIndex, data}, res)
+	}
+}
+
+// deliver queues p for each call that res matches, or handles it per s.Unmatched if there
+// are none.
+func (s *Session) deliver(p sessionPacket, res *http.Response) {
+	corr := s.correlate()
+	s.mu.Lock()
+	var matched []*sessionCall
+	for c := range s.calls {
+		if corr.Match(c.req, c.dest, p.addr, res) {
+			matched = append(matched, c)
+		}
+	}
+	if len(matched) == 0 && s.Unmatched == DeliverUnmatched {
+		for c := range s.calls {
+			matched = append(matched, c)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(matched) == 0 {
+		if s.Unmatched == HandleUnmatched && s.UnmatchedHandler != nil {
+			s.UnmatchedHandler(p.addr, res)
+		} else {
+			s.transport().logger().Debug("uhttp: unmatched response dropped", "sender", p.addr.String())
+		}
+		return
+	}
+	for _, c := range matched {
+		select {
+		case c.ch <- p:
+		default:
+			// Never let one slow caller hold up the others.
+			s.transport().logger().Warn("uhttp: response queue full, dropped", "sender", p.addr.String())
+		}
+	}
+}
+
+// RoundTripMulti sends req from the session's socket and calls fn for each matching response
+// received.  Returns when wait is reached (no error), req.Context() expires, the session is
+// closed, or when fn returns an error.  The sentinal error Stop may be returned by fn to cause
+// this method to return immediately without error.
+//
+// Up to 64 responses are queued while fn is running; if fn falls further behind than that,
+// further responses to this request are dropped.
+func (s *Session) RoundTripMulti(req *http.Request, wait time.Duration, fn func(sender net.Addr, r *http.Response) error) (err error) {
+	t := s.transport()
+	if err = t.validate(); err == nil {
+		err = validateRequest(req)
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	trace := ContextClientTrace(ctx)
+	metrics := t.metrics()
+
+	enc, nonce, err := t.encodeRequest(req)
+	if err != nil {
+		return err
+	}
+	reqBuf := t.newBuf()
+	defer t.releaseBuf(reqBuf)
+	var repeats sync.WaitGroup
+	defer func() {
+		// Stop repeating before reqBuf is released.
+		cancel()
+		repeats.Wait()
+	}()
+	data, err := t.appendMessage((*reqBuf)[:0], enc, t.maxRequestSize(), false)
+	if err != nil {
+		return err
+	}
+	*reqBuf = data[:0]
+
+	raddr, err := net.ResolveUDPAddr("udp", req.URL.Host)
+	if err != nil {
+		return fmt.Errorf("uhttp: resolve %q: %v", req.URL.Host, err)
+	}
+	trace.resolved(raddr)
+	log := t.logger().With(slog.Uint64("request_id", lastRequestID.Add(1)), slog.String("dest", raddr.String()))
+	if raddr.Zone != "" {
+		log = log.With(slog.String("iface", raddr.Zone))
+	}
+
+	conn, done, err := s.open()
+	if err != nil {
+		return err
+	}
+	if t.DialContext != nil && !raddr.IP.Equal(net.IPv4bcast) && !raddr.IP.IsMulticast() {
+		if conn, err = s.dial(ctx, raddr); err != nil {
+			return err
+		}
+	}
+	call := &sessionCall{req: req, dest: raddr, ch: make(chan sessionPacket, sessionQueueLen)}
+	s.mu.Lock()
+	s.calls[call] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.calls, call)
+		s.mu.Unlock()
+	}()
+
+	n, err := writeTo(conn, data, raddr)
+	if err != nil {
+		log.WarnContext(ctx, "uhttp: send failed", "error", err)
+		return fmt.Errorf("uhttp send request: %v", err)
+	}
+	trace.requestWritten(n)
+	t.sent(MetricRequestsSent, n)
+	log.DebugContext(ctx, "uhttp: request sent", "bytes", n)
+	sentAt := t.clock().Now()
+	var stats RoundTripStats
+	defer func() { t.finished(ctx, log, stats) }()
+	limiter := t.newReceiveLimiter()
+
+	if t.Repeat != nil {
+		repeats.Add(1)
+		go func() {
+			defer repeats.Done()
+			repeat(ctx, t.clock(), t.Repeat(), func(num int) error {
+				n, err := writeTo(conn, data, raddr)
+				if err != nil {
+					log.DebugContext(ctx, "uhttp: repeat failed", "repeat", num, "error", err)
+					return err
+				}
+				t.sent(MetricRepeatsSent, n)
+				log.DebugContext(ctx, "uhttp: repeat sent", "repeat", num, "bytes", n)
+				return nil
+			})
+		}()
+	}
+
+	if wait == 0 {
+		wait = t.WaitTime
+	}
+	var waitCh <-chan time.Time
+	if wait > 0 {
+		timer := t.clock().NewTimer(wait)
+		defer timer.Stop()
+		waitCh = timer.C()
+	}
+
+	accept := newAcceptor(t.AcceptFrom, raddr)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			s.mu.Lock()
+			err = s.doneErr
+			s.mu.Unlock()
+			return err
+		case <-waitCh:
+			trace.waitExpired()
+			log.DebugContext(ctx, "uhttp: wait expired", "wait", wait, "responses", stats.Responses)
+			return err
+		case p := <-call.ch:
+			trace.packetReceived(p.addr, len(p.data))
+			stats.Packets++
+			if reason := accept.checkSender(p.addr, p.ifIndex); reason != 0 {
+				stats.Rejected++
+				t.rejected(ctx, log, p.addr, reason)
+				continue
+			}
+			if !limiter.admit(t.clock().Now(), p.addr, &stats) {
+				metrics.Add(MetricDropped, 1)
+				continue
+			}
+			r, er := t.parseResponse(p.addr, p.data, req)
+			if er == nil && t.Signer != nil {
+				if er = t.Signer.verifyResponse(r, nonce, t.maxMessageSize()); er != nil {
+					stats.Rejected++
+					metrics.Add(MetricSignatureFailures, 1)
+					t.rejected(ctx, log, p.addr, RejectBadSignature)
+					continue
+				}
+			}
+			if er == nil {
+				er = t.decodeResponse(r)
+			}
+			if er != nil {
+				err = fmt.Errorf("uhttp: parse response: %v", er)
+				trace.parseFailed(p.addr, er)
+				continue
+			}
+			if reason := accept.checkResponse(p.addr, r); reason != 0 {
+				stats.Rejected++
+				t.rejected(ctx, log, p.addr, reason)
+				continue
+			}
+			trace.responseParsed(p.addr, r)
+			metrics.Observe(MetricResponseLatency, t.clock().Now().Sub(sentAt).Seconds())
+			stats.Responses++
+			if er := fn(p.addr, r); er != nil {
+				if er == Stop {
+					er = nil
+				}
+				return er
+			}
+		}
+	}
+}
+
+// RoundTrip issues req and returns the first matching response received.
+func (s *Session) RoundTrip(req *http.Request) (*http.Response, error) {
+	return roundTripFirst(s, req)
+}
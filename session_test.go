@@ -0,0 +1,235 @@
+package uhttp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnesting/uhttp"
+)
+
+// echoServer starts a Server that responds with its name and the request's X-Id header.
+func echoServer(t *testing.T, name string) string {
+	return serve(t, &uhttp.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Id", r.Header.Get("X-Id"))
+		io.WriteString(w, name+" "+r.Header.Get("X-Id"))
+	})}, nil)
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	addr := echoServer(t, "a")
+	s := &uhttp.Session{Correlate: uhttp.ByHeader("X-Id")}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprint(i)
+			req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+			req.Header.Set("X-Id", id)
+			var got []string
+			err := s.RoundTripMulti(req, 300*time.Millisecond, func(_ net.Addr, res *http.Response) error {
+				b, _ := io.ReadAll(res.Body)
+				got = append(got, string(b))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(got) != 1 || got[0] != "a "+id {
+				t.Errorf("request %s got %q", id, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSessionBySender(t *testing.T) {
+	addrs := []string{echoServer(t, "a"), echoServer(t, "b")}
+	s := &uhttp.Session{}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+			res, err := s.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, _ := io.ReadAll(res.Body)
+			if want := []string{"a ", "b "}[i]; string(b) != want {
+				t.Errorf("response from %s = %q, want %q", addr, b, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSessionUnmatched(t *testing.T) {
+	addr := echoServer(t, "a")
+
+	var mu sync.Mutex
+	var unmatched []string
+	s := &uhttp.Session{
+		Correlate: uhttp.ByHeader("X-Other"),
+		Unmatched: uhttp.HandleUnmatched,
+		UnmatchedHandler: func(sender net.Addr, res *http.Response) {
+			mu.Lock()
+			defer mu.Unlock()
+			unmatched = append(unmatched, res.Header.Get("X-Id"))
+		},
+	}
+	defer s.Close()
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header.Set("X-Id", "1")
+	n := 0
+	if err := s.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n != 0 || len(unmatched) != 1 || unmatched[0] != "1" {
+		t.Errorf("delivered %d, unmatched %q", n, unmatched)
+	}
+
+	s.Unmatched = uhttp.DeliverUnmatched
+	if err := s.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("delivered %d with DeliverUnmatched, want 1", n)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	// Nothing listens here, so the request will wait until the session is closed.
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer conn.Close()
+
+	s := &uhttp.Session{}
+	errc := make(chan error)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+conn.LocalAddr().String()+"/", nil)
+		errc <- s.RoundTripMulti(req, 10*time.Second, func(net.Addr, *http.Response) error { return nil })
+	}()
+	// Wait for the request to arrive before closing.
+	conn.ReadFrom(make([]byte, 1024))
+	s.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, uhttp.ErrSessionClosed) {
+			t.Errorf("RoundTripMulti = %v, want ErrSessionClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RoundTripMulti did not return after Close")
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+conn.LocalAddr().String()+"/", nil)
+	if _, err := s.RoundTrip(req); !errors.Is(err, uhttp.ErrSessionClosed) {
+		t.Errorf("RoundTrip after Close = %v, want ErrSessionClosed", err)
+	}
+}
+
+func TestSessionTransportSettings(t *testing.T) {
+	var seen []string
+	var mu sync.Mutex
+	addr := serve(t, &uhttp.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.RemoteAddr)
+		mu.Unlock()
+		if r.Header.Get("Uhttp-Accept-Fragments") != "" {
+			t.Error("session offered to reassemble fragments")
+		}
+		w.Header().Set("St", r.Header.Get("St"))
+		w.WriteHeader(http.StatusOK)
+	})}, nil)
+
+	c, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	local := c.LocalAddr().String()
+	c.Close()
+
+	dials := 0
+	for _, tc := range []struct {
+		desc string
+		tr   *uhttp.Transport
+	}{
+		{"LocalAddr", &uhttp.Transport{Fragmentation: true, LocalAddr: local}},
+		{"DialContext", &uhttp.Transport{Fragmentation: true, DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials++
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}}},
+	} {
+		s := &uhttp.Session{Transport: tc.tr, Correlate: uhttp.ByST}
+		for range 2 {
+			req, _ := http.NewRequest("M-SEARCH", "http://"+addr+"/", nil)
+			// Headers sent from an OrderedHeader are correlated too.
+			req = req.WithContext(uhttp.WithOrderedHeader(req.Context(), uhttp.OrderedHeader{{Name: "ST", Value: "urn:x"}}))
+			res, err := s.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.desc, err)
+			}
+			if st := res.Header.Get("St"); st != "urn:x" {
+				t.Errorf("%s: ST = %q", tc.desc, st)
+			}
+		}
+		s.Close()
+	}
+	if dials != 1 {
+		t.Errorf("dialed %d times, want 1", dials)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 4 || seen[0] != local || seen[1] != local {
+		t.Errorf("requests came from %q, want the first two from %s", seen, local)
+	}
+}
+
+func TestSessionCloseWhileDialing(t *testing.T) {
+	addr := serve(t, &uhttp.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}, nil)
+	for range 20 {
+		dialing := make(chan struct{})
+		release := make(chan struct{})
+		var dialed net.Conn
+		s := &uhttp.Session{Transport: &uhttp.Transport{DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			close(dialing)
+			<-release
+			var d net.Dialer
+			c, err := d.DialContext(ctx, network, address)
+			dialed = c
+			return c, err
+		}}}
+		errc := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+			errc <- s.RoundTripMulti(req, time.Second, func(net.Addr, *http.Response) error { return nil })
+		}()
+		<-dialing
+		s.Close()
+		close(release)
+		if err := <-errc; !errors.Is(err, uhttp.ErrSessionClosed) {
+			t.Fatalf("RoundTripMulti = %v, want ErrSessionClosed", err)
+		}
+		if _, err := dialed.Write([]byte("x")); err == nil {
+			t.Fatal("connection dialed after Close left open")
+		}
+	}
+}
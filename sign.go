@@ -0,0 +1,384 @@
+package uhttp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureHeader carries the signature of a message signed by a Signer, in the form
+//
+//	Uhttp-Signature: keyid=<id>, ts=<unix seconds>, nonce=<hex>, sig=<base64 HMAC-SHA256>
+const signatureHeader = "Uhttp-Signature"
+
+// defaultSignatureWindow is the default for Signer.Window.
+const defaultSignatureWindow = 30 * time.Second
+
+// DefaultSignedHeaders are the headers covered by a signature if Signer.Headers is nil.  They
+// are the ones SSDP uses to describe what is being searched for or announced.
+var DefaultSignedHeaders = []string{"Host", "Location", "Man", "Mx", "Nt", "Nts", "St", "Usn", "Content-Type"}
+
+// Errors reported when a message fails verification.
+var (
+	ErrUnsigned     = errors.New("uhttp: message is not signed")
+	ErrBadSignature = errors.New("uhttp: invalid message signature")
+	ErrUnknownKey   = errors.New("uhttp: message signed with unknown key")
+	ErrStale        = errors.New("uhttp: message timestamp outside window")
+	ErrReplay       = errors.New("uhttp: message replayed")
+)
+
+// Signer authenticates messages exchanged between uhttp clients and servers that share a set
+// of keys.  Each message is signed with an HMAC-SHA256 over its method and request URI (or its
+// status code), a timestamp, a random nonce, the headers listed in Headers, and its body.
+// Responses also cover the nonce of the request they answer, so that they can't be replayed
+// in answer to another.  Receivers reject messages whose timestamp is outside Window, and
+// messages whose nonce has already been seen within it.
+//
+// Since repeated requests carry the same nonce, servers verifying requests will answer only
+// the first copy to arrive.
+//
+// Keys are identified by an ID carried with each signature, so that keys can be rotated: add
+// the new key with AddKey on all receivers, switch senders to it with UseKey, and then remove
+// the old key with RemoveKey.  Use NewSigner to create a Signer.
+type Signer struct {
+	// Headers lists the headers covered by signatures.  A nil value uses DefaultSignedHeaders.
+	Headers []string
+
+	// Window is how far a message's timestamp may be from the receiver's clock.  A zero value
+	// will use the default of 30s.
+	Window time.Duration
+
+	// Clock is used for timestamps.  A nil value uses SystemClock.
+	Clock Clock
+
+	mu        sync.Mutex
+	keys      map[string][]byte
+	keyID     string
+	seen      map[string]time.Time // nonces received, by the time they were received
+	lastSweep time.Time
+}
+
+// NewSigner returns a Signer that signs with key, identified by keyID.
+func NewSigner(keyID string, key []byte) *Signer {
+	s := &Signer{keys: make(map[string][]byte), seen: make(map[string]time.Time)}
+	s.AddKey(keyID, key)
+	s.keyID = keyID
+	return s
+}
+
+// AddKey adds a key that will be accepted when verifying messages.
+func (s *Signer) AddKey(keyID string, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[keyID] = slices.Clone(key)
+}
+
+// RemoveKey stops accepting messages signed with keyID.  It cannot remove the key used for
+// signing.
+func (s *Signer) RemoveKey(keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keyID == s.keyID {
+		return fmt.Errorf("uhttp: key %q is in use for signing", keyID)
+	}
+	delete(s.keys, keyID)
+	return nil
+}
+
+// UseKey signs future messages with the key identified by keyID, which must already have
+// been added.
+func (s *Signer) UseKey(keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[keyID]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	s.keyID = keyID
+	return nil
+}
+
+func (s *Signer) clock() Clock {
+	if s.Clock != nil {
+		return s.Clock
+	}
+	return SystemClock
+}
+
+func (s *Signer) window() time.Duration {
+	if s.Window > 0 {
+		return s.Window
+	}
+	return defaultSignatureWindow
+}
+
+func (s *Signer) headers() []string {
+	if s.Headers != nil {
+		return s.Headers
+	}
+	return DefaultSignedHeaders
+}
+
+// signature is a parsed Uhttp-Signature header.
+type signature struct {
+	keyID string
+	ts    int64
+	nonce string
+	mac   []byte
+}
+
+func (sig signature) String() string {
+	return "keyid=" + sig.keyID + ", ts=" + strconv.FormatInt(sig.ts, 10) + ", nonce=" + sig.nonce +
+		", sig=" + base64.StdEncoding.EncodeToString(sig.mac)
+}
+
+func parseSignature(v string) (sig signature, ok bool) {
+	var haveTS bool
+	for _, part := range strings.Split(v, ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "keyid":
+			sig.keyID = val
+		case "ts":
+			n, err := strconv.ParseInt(val, 10, 64)
+			sig.ts, haveTS = n, err == nil
+		case "nonce":
+			sig.nonce = val
+		case "sig":
+			// The value may itself end in '=', so take everything after the first.
+			_, val, _ = strings.Cut(strings.TrimSpace(part), "=")
+			b, err := base64.StdEncoding.DecodeString(val)
+			if err != nil {
+				return sig, false
+			}
+			sig.mac = b
+		}
+	}
+	return sig, haveTS && sig.keyID != "" && sig.nonce != "" && sig.mac != nil
+}
+
+// signedMessage describes the parts of a message covered by a signature.
+type signedMessage struct {
+	start    string // method and request URI, or status code
+	host     string // as sent, or empty if none was
+	header   http.Header
+	body     []byte
+	reqNonce string // nonce of the request a response answers
+}
+
+// mac computes the signature of m with sig's timestamp and nonce under key.
+func (s *Signer) mac(key []byte, sig signature, m signedMessage) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, m.start+"\n")
+	io.WriteString(h, strconv.FormatInt(sig.ts, 10)+"\n"+sig.nonce+"\n"+m.reqNonce+"\n")
+	for _, name := range s.headers() {
+		var values []string
+		if !strings.EqualFold(name, "Host") {
+			values = m.header.Values(name)
+		} else if m.host != "" {
+			values = []string{m.host}
+		}
+		// Length-prefix each value, so that no two different lists of values look alike.
+		io.WriteString(h, strings.ToLower(name)+":"+strconv.Itoa(len(values))+"\n")
+		for _, v := range values {
+			io.WriteString(h, strconv.Itoa(len(v))+":"+v+"\n")
+		}
+	}
+	sum := sha256.Sum256(m.body)
+	io.WriteString(h, hex.EncodeToString(sum[:]))
+	return h.Sum(nil)
+}
+
+// sign returns a signature for m with the current key.
+func (s *Signer) sign(m signedMessage) signature {
+	var nonce [12]byte
+	rand.Read(nonce[:])
+	s.mu.Lock()
+	keyID, key := s.keyID, s.keys[s.keyID]
+	s.mu.Unlock()
+	sig := signature{keyID: keyID, ts: s.clock().Now().Unix(), nonce: hex.EncodeToString(nonce[:])}
+	sig.mac = s.mac(key, sig, m)
+	return sig
+}
+
+// verify checks the signature of m, carried in its header, and records its nonce.  Returns
+// the nonce of the message.
+func (s *Signer) verify(m signedMessage) (nonce string, err error) {
+	v := m.header.Get(signatureHeader)
+	if v == "" {
+		return "", ErrUnsigned
+	}
+	sig, ok := parseSignature(v)
+	if !ok {
+		return "", ErrBadSignature
+	}
+	now := s.clock().Now()
+	if d := now.Sub(time.Unix(sig.ts, 0)).Abs(); d > s.window() {
+		return "", ErrStale
+	}
+
+	s.mu.Lock()
+	key, ok := s.keys[sig.keyID]
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, sig.keyID)
+	}
+	if !hmac.Equal(sig.mac, s.mac(key, sig, m)) {
+		return "", ErrBadSignature
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	id := sig.keyID + "/" + sig.nonce
+	if _, dup := s.seen[id]; dup {
+		return "", ErrReplay
+	}
+	s.seen[id] = now
+	return sig.nonce, nil
+}
+
+// sweep forgets nonces old enough that their messages would be rejected as stale anyway.
+// s.mu must be held.
+func (s *Signer) sweep(now time.Time) {
+	w := s.window()
+	if now.Sub(s.lastSweep) < w {
+		return
+	}
+	s.lastSweep = now
+	for id, t := range s.seen {
+		if now.Sub(t) > 2*w {
+			delete(s.seen, id)
+		}
+	}
+}
+
+// readAllLimit reads body in full, up to limit bytes.
+func readAllLimit(body io.Reader, limit int) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err == nil && len(b) > limit {
+		err = fmt.Errorf("%w of %d", ErrRequestTooLarge, limit)
+	}
+	return b, err
+}
+
+// sentHost returns the Host header that t will send with req, or "" if it will send none.
+func (t *Transport) sentHost(req *http.Request) string {
+	if oh := ContextOrderedHeader(req.Context()); oh.Has("Host") {
+		return oh.Header().Get("Host")
+	}
+	if t.OmitAutoHeaders&AutoHost != 0 || !t.keepsHeader("Host") {
+		return ""
+	}
+	if req.Host != "" {
+		return removeZone(req.Host)
+	}
+	return removeZone(req.URL.Host)
+}
+
+// keepsHeader reports whether t.HeaderCanon leaves the header name recognizable to the
+// receiver, rather than omitting or renaming it.
+func (t *Transport) keepsHeader(name string) bool {
+	return t.HeaderCanon == nil || strings.EqualFold(t.HeaderCanon(http.CanonicalHeaderKey(name)), name)
+}
+
+// checkSigned returns an error if t.HeaderCanon would omit or rename the signature of req, or
+// any header in req covered by it, so that the request would fail verification.
+func (t *Transport) checkSigned(req *http.Request) error {
+	if ContextOrderedHeader(req.Context()) != nil {
+		return nil // sent exactly as given
+	}
+	if !t.keepsHeader(signatureHeader) {
+		return fmt.Errorf("uhttp: HeaderCanon omits or renames %s", signatureHeader)
+	}
+	for _, name := range t.Signer.headers() {
+		if _, ok := req.Header[http.CanonicalHeaderKey(name)]; ok && !t.keepsHeader(name) {
+			return fmt.Errorf("uhttp: HeaderCanon omits or renames signed header %s", name)
+		}
+	}
+	return nil
+}
+
+// signRequest returns a copy of req carrying a signature, along with the signature's nonce.
+// host is the Host header that will be sent with it, if any.  Its body is read in full, up to
+// limit bytes.
+func (s *Signer) signRequest(req *http.Request, host string, limit int) (*http.Request, string, error) {
+	body, err := readAllLimit(req.Body, limit)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	out := req.Clone(req.Context())
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+	header := out.Header
+	oh := ContextOrderedHeader(out.Context())
+	if oh != nil {
+		header = oh.Header()
+	}
+	sig := s.sign(signedMessage{
+		start:  out.Method + " " + out.URL.RequestURI(),
+		host:   host,
+		header: header,
+		body:   body,
+	})
+	out.Header.Set(signatureHeader, sig.String())
+	if oh != nil {
+		oh = append(oh[:len(oh):len(oh)], HeaderField{signatureHeader, sig.String()})
+		out = out.WithContext(WithOrderedHeader(out.Context(), oh))
+	}
+	return out, sig.nonce, nil
+}
+
+// verifyRequest checks the signature of req, replacing its body with one that can be read
+// again.  Returns the request's nonce, for signing the response.
+func (s *Signer) verifyRequest(req *http.Request, limit int) (string, error) {
+	body, err := readAllLimit(req.Body, limit)
+	if err != nil {
+		return "", err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return s.verify(signedMessage{
+		start:  req.Method + " " + req.URL.RequestURI(),
+		host:   req.Host,
+		header: req.Header,
+		body:   body,
+	})
+}
+
+// signResponse adds a signature to header for a response with the given status code and
+// body, answering the request with nonce reqNonce.
+func (s *Signer) signResponse(code int, header http.Header, body []byte, reqNonce string) {
+	sig := s.sign(signedMessage{start: strconv.Itoa(code), header: header, body: body, reqNonce: reqNonce})
+	header.Set(signatureHeader, sig.String())
+}
+
+// verifyResponse checks the signature of res, which answers the request with nonce reqNonce,
+// replacing its body with one that can be read again.
+func (s *Signer) verifyResponse(res *http.Response, reqNonce string, limit int) error {
+	body, err := readAllLimit(res.Body, limit)
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	_, err = s.verify(signedMessage{start: strconv.Itoa(res.StatusCode), header: res.Header, body: body, reqNonce: reqNonce})
+	return err
+}
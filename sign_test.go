@@ -0,0 +1,199 @@
+package uhttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripSigned signs req with from, puts it on the wire and parses it back, and verifies
+// it with to.
+func roundTripSigned(t *testing.T, from, to *Signer, req *http.Request, tamper func([]byte) []byte) (string, error) {
+	t.Helper()
+	tr := &Transport{Signer: from}
+	var buf bytes.Buffer
+	if err := tr.WriteRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if tamper != nil {
+		data = tamper(data)
+	}
+	got, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return to.verifyRequest(got, 1<<20)
+}
+
+func newSearch(body string) *http.Request {
+	req, _ := http.NewRequest("M-SEARCH", "http://239.255.255.250:1900/", strings.NewReader(body))
+	req.Header.Set("MAN", `"ssdp:discover"`)
+	req.Header.Set("ST", "ssdp:all")
+	return req
+}
+
+func TestSignerRequest(t *testing.T) {
+	key := []byte("secret")
+	if _, err := roundTripSigned(t, NewSigner("k1", key), NewSigner("k1", key), newSearch("hello"), nil); err != nil {
+		t.Errorf("valid request: %v", err)
+	}
+
+	tampers := map[string]func([]byte) []byte{
+		"body": func(b []byte) []byte { return bytes.Replace(b, []byte("hello"), []byte("jello"), 1) },
+		"header": func(b []byte) []byte {
+			return bytes.Replace(b, []byte("ssdp:all"), []byte("upnp:all"), 1)
+		},
+		"method": func(b []byte) []byte { return bytes.Replace(b, []byte("M-SEARCH"), []byte("NOTIFY"), 1) },
+	}
+	for name, tamper := range tampers {
+		if _, err := roundTripSigned(t, NewSigner("k1", key), NewSigner("k1", key), newSearch("hello"), tamper); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("tampered %s: got %v, want ErrBadSignature", name, err)
+		}
+	}
+
+	if _, err := roundTripSigned(t, NewSigner("k1", key), NewSigner("k1", []byte("other")), newSearch(""), nil); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("wrong key: got %v, want ErrBadSignature", err)
+	}
+	if _, err := roundTripSigned(t, NewSigner("k1", key), NewSigner("k2", key), newSearch(""), nil); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown key: got %v, want ErrUnknownKey", err)
+	}
+
+	unsigned, _ := http.ReadRequest(bufio.NewReader(strings.NewReader("M-SEARCH * HTTP/1.1\r\nHost: x\r\n\r\n")))
+	if _, err := NewSigner("k1", key).verifyRequest(unsigned, 1<<20); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned: got %v, want ErrUnsigned", err)
+	}
+}
+
+func TestSignerTransportSettings(t *testing.T) {
+	key := []byte("secret")
+	send := func(tr *Transport) error {
+		tr.Signer = NewSigner("k1", key)
+		var buf bytes.Buffer
+		if err := tr.WriteRequest(&buf, newSearch("hello")); err != nil {
+			return err
+		}
+		req, err := http.ReadRequest(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewSigner("k1", key).verifyRequest(req, 1<<20)
+		return err
+	}
+
+	if err := send(&Transport{OmitAutoHeaders: AutoHost}); err != nil {
+		t.Errorf("without Host: %v", err)
+	}
+	if err := send(&Transport{HeaderCanon: strings.ToLower}); err != nil {
+		t.Errorf("lowercase headers: %v", err)
+	}
+	for _, drop := range []string{"St", "Uhttp-Signature"} {
+		canon := func(name string) string {
+			if name == drop {
+				return ""
+			}
+			return name
+		}
+		if err := send(&Transport{HeaderCanon: canon}); err == nil || errors.Is(err, ErrBadSignature) {
+			t.Errorf("omitting %s: got %v, want an error from WriteRequest", drop, err)
+		}
+	}
+}
+
+func TestSignerHeaderValues(t *testing.T) {
+	s := NewSigner("k1", []byte("secret"))
+	sig := signature{keyID: "k1", nonce: "n"}
+	mac := func(values ...string) []byte {
+		return s.mac([]byte("secret"), sig, signedMessage{header: http.Header{"St": values}})
+	}
+	if bytes.Equal(mac("a,b"), mac("a", "b")) {
+		t.Error("joined and separate header values have the same signature")
+	}
+	if bytes.Equal(mac(), mac("")) {
+		t.Error("missing and empty header have the same signature")
+	}
+}
+
+func TestSignerReplayAndWindow(t *testing.T) {
+	key := []byte("secret")
+	clock := &fixedClock{time.Unix(1700000000, 0)}
+	from := NewSigner("k1", key)
+	from.Clock = clock
+	to := NewSigner("k1", key)
+	to.Clock = clock
+
+	var buf bytes.Buffer
+	if err := (&Transport{Signer: from}).WriteRequest(&buf, newSearch("")); err != nil {
+		t.Fatal(err)
+	}
+	verify := func() error {
+		req, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+		_, err := to.verifyRequest(req, 1<<20)
+		return err
+	}
+	if err := verify(); err != nil {
+		t.Fatalf("first copy: %v", err)
+	}
+	if err := verify(); !errors.Is(err, ErrReplay) {
+		t.Errorf("second copy: got %v, want ErrReplay", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if err := verify(); !errors.Is(err, ErrStale) {
+		t.Errorf("late copy: got %v, want ErrStale", err)
+	}
+}
+
+func TestSignerRotation(t *testing.T) {
+	old, next := []byte("old"), []byte("new")
+	sender := NewSigner("k1", old)
+	receiver := NewSigner("k1", old)
+
+	receiver.AddKey("k2", next)
+	sender.AddKey("k2", next)
+	if err := sender.UseKey("k2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roundTripSigned(t, sender, receiver, newSearch(""), nil); err != nil {
+		t.Errorf("after rotation: %v", err)
+	}
+
+	if err := receiver.RemoveKey("k1"); err == nil {
+		t.Error("removed the key in use for signing")
+	}
+	receiver.UseKey("k2")
+	if err := receiver.RemoveKey("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roundTripSigned(t, NewSigner("k1", old), receiver, newSearch(""), nil); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("retired key: got %v, want ErrUnknownKey", err)
+	}
+	if err := sender.UseKey("k3"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("UseKey of missing key: got %v", err)
+	}
+}
+
+func TestSignerResponse(t *testing.T) {
+	key := []byte("secret")
+	server, client := NewSigner("k1", key), NewSigner("k1", key)
+	header := http.Header{"St": {"upnp:rootdevice"}}
+	server.signResponse(200, header, []byte("body"), "abc")
+
+	res := func() *http.Response {
+		return &http.Response{StatusCode: 200, Header: header.Clone(), Body: io.NopCloser(strings.NewReader("body"))}
+	}
+	if err := client.verifyResponse(res(), "xyz", 1<<20); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("answer to another request: got %v, want ErrBadSignature", err)
+	}
+	r := res()
+	if err := client.verifyResponse(r, "abc", 1<<20); err != nil {
+		t.Errorf("valid response: %v", err)
+	}
+	if b, _ := io.ReadAll(r.Body); string(b) != "body" {
+		t.Errorf("body after verify = %q", b)
+	}
+}
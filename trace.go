@@ -0,0 +1,150 @@
+package uhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+// ClientTrace is a set of hooks to run at various stages of a round trip, for diagnosing
+// requests that go unanswered.  Any particular hook may be nil.  Hooks may be called
+// concurrently from different goroutines, since repeats are sent in the background.  It is
+// attached to a request with WithClientTrace, in the style of net/http/httptrace.
+type ClientTrace struct {
+	// Resolved is called once the destination of the request has been resolved.
+	Resolved func(addr *net.UDPAddr)
+
+	// SocketOpened is called once the socket used for the request is open, with its local
+	// address.
+	SocketOpened func(laddr net.Addr)
+
+	// RequestWritten is called once the request has been sent, with its size in bytes.
+	RequestWritten func(n int)
+
+	// RepeatSent is called each time a repeat of the request is sent.  n counts repeats
+	// starting at 1.
+	RepeatSent func(n int)
+
+	// PacketReceived is called for each packet received, before it is parsed.
+	PacketReceived func(sender net.Addr, size int)
+
+	// PacketRejected is called for each packet discarded because of Transport.AcceptFrom.
+	PacketRejected func(sender net.Addr, reason RejectReason)
+
+	// ResponseParsed is called for each packet successfully parsed, before it is delivered.
+	ResponseParsed func(sender net.Addr, res *http.Response)
+
+	// ParseFailed is called for each packet that could not be parsed as a response.
+	ParseFailed func(sender net.Addr, err error)
+
+	// WaitExpired is called when the wait time for responses elapses.
+	WaitExpired func()
+
+	// Finished is called when the round trip returns, with a summary of the packets received.
+	Finished func(stats RoundTripStats)
+}
+
+type clientTraceKey struct{}
+
+// ContextClientTrace returns the ClientTrace associated with ctx, or nil if there is none.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// WithClientTrace returns a new context based on ctx that will invoke the hooks in trace for
+// requests made with it.  Any hooks already associated with ctx are also called, after those
+// in trace.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+	if old := ContextClientTrace(ctx); old != nil {
+		trace = trace.compose(old)
+	}
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// compose returns a ClientTrace whose hooks call those of t and then those of old.
+func (t *ClientTrace) compose(old *ClientTrace) *ClientTrace {
+	merged := *t
+	tv := reflect.ValueOf(&merged).Elem()
+	ov := reflect.ValueOf(old).Elem()
+	for i := 0; i < tv.NumField(); i++ {
+		tf, of := tv.Field(i), ov.Field(i)
+		if of.IsNil() {
+			continue
+		}
+		if tf.IsNil() {
+			tf.Set(of)
+			continue
+		}
+		first, second := tf.Interface(), of
+		tf.Set(reflect.MakeFunc(tf.Type(), func(args []reflect.Value) []reflect.Value {
+			reflect.ValueOf(first).Call(args)
+			return second.Call(args)
+		}))
+	}
+	return &merged
+}
+
+func (t *ClientTrace) resolved(addr *net.UDPAddr) {
+	if t != nil && t.Resolved != nil {
+		t.Resolved(addr)
+	}
+}
+
+func (t *ClientTrace) socketOpened(laddr net.Addr) {
+	if t != nil && t.SocketOpened != nil {
+		t.SocketOpened(laddr)
+	}
+}
+
+func (t *ClientTrace) requestWritten(n int) {
+	if t != nil && t.RequestWritten != nil {
+		t.RequestWritten(n)
+	}
+}
+
+func (t *ClientTrace) repeatSent(n int) {
+	if t != nil && t.RepeatSent != nil {
+		t.RepeatSent(n)
+	}
+}
+
+func (t *ClientTrace) packetReceived(sender net.Addr, size int) {
+	if t != nil && t.PacketReceived != nil {
+		t.PacketReceived(sender, size)
+	}
+}
+
+func (t *ClientTrace) packetRejected(sender net.Addr, reason RejectReason) {
+	if t != nil && t.PacketRejected != nil {
+		t.PacketRejected(sender, reason)
+	}
+}
+
+func (t *ClientTrace) responseParsed(sender net.Addr, res *http.Response) {
+	if t != nil && t.ResponseParsed != nil {
+		t.ResponseParsed(sender, res)
+	}
+}
+
+func (t *ClientTrace) parseFailed(sender net.Addr, err error) {
+	if t != nil && t.ParseFailed != nil {
+		t.ParseFailed(sender, err)
+	}
+}
+
+func (t *ClientTrace) waitExpired() {
+	if t != nil && t.WaitExpired != nil {
+		t.WaitExpired()
+	}
+}
+
+func (t *ClientTrace) finished(stats RoundTripStats) {
+	if t != nil && t.Finished != nil {
+		t.Finished(stats)
+	}
+}
@@ -0,0 +1,89 @@
+package uhttp_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnesting/uhttp"
+)
+
+func TestClientTrace(t *testing.T) {
+	var mu sync.Mutex
+	var count int
+	addr, _ := listenUDP(t, func([]byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if count++; count == 1 {
+			return []byte("garbage")
+		}
+		return []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	var events []string
+	record := func(ev string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	trace := &uhttp.ClientTrace{
+		Resolved:       func(*net.UDPAddr) { record("resolved") },
+		SocketOpened:   func(net.Addr) { record("opened") },
+		RequestWritten: func(int) { record("written") },
+		RepeatSent:     func(n int) { record("repeat") },
+		PacketReceived: func(net.Addr, int) { record("received") },
+		ResponseParsed: func(net.Addr, *http.Response) { record("parsed") },
+		ParseFailed:    func(net.Addr, error) { record("failed") },
+		WaitExpired:    func() { record("expired") },
+	}
+	var outer int
+	ctx := uhttp.WithClientTrace(context.Background(), &uhttp.ClientTrace{
+		WaitExpired: func() { outer++ },
+	})
+	ctx = uhttp.WithClientTrace(ctx, trace)
+
+	tr := &uhttp.Transport{Repeat: uhttp.RepeatAfter(10*time.Millisecond, 1)}
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/", nil)
+	var responses int
+	err := tr.RoundTripMulti(req, 300*time.Millisecond, func(net.Addr, *http.Response) error {
+		responses++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("did not expect error, got %v", err)
+	}
+	if responses != 1 {
+		t.Errorf("expected 1 response, got %d", responses)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]int{
+		"resolved": 1,
+		"opened":   1,
+		"written":  1,
+		"repeat":   1,
+		"received": 2,
+		"parsed":   1,
+		"failed":   1,
+		"expired":  1,
+	}
+	actual := make(map[string]int)
+	for _, ev := range events {
+		actual[ev]++
+	}
+	for ev, n := range expected {
+		if actual[ev] != n {
+			t.Errorf("expected %s to be called %d times, got %d (events %v)", ev, n, actual[ev], events)
+		}
+	}
+	if events[0] != "resolved" || events[len(events)-1] != "expired" {
+		t.Errorf("expected events to start with resolved and end with expired, got %v", events)
+	}
+	if outer != 1 {
+		t.Errorf("expected hooks from the outer trace to be called too, got %d calls", outer)
+	}
+}
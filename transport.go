@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http/httpguts"
@@ -17,13 +20,26 @@ import (
 
 const defaultPacketSize = 8192
 
+// maxPacketSize is the largest UDP payload that can be sent over IPv4.
+const maxPacketSize = 65507
+
 // Transport implements http.RoundTripper and RoundTripMultier and allows for sending HTTP requests
 // over UDP.  It supports both unicast and multicast destinations.
 type Transport struct {
-	// MaxSize is the maximum allowable size of an HTTP Request.  It cannot be larger than 64k (UDP limit).
-	// A zero value will use the default of 8k.
+	// MaxSize is the maximum allowable size of an HTTP Request or Response, unless overridden by
+	// MaxRequestSize or MaxResponseSize.  It cannot be larger than 65507 (UDP limit).  A zero
+	// value will use the default of 8k.
 	MaxSize int
 
+	// MaxRequestSize is the maximum allowable size of an HTTP Request.  It cannot be larger than
+	// 65507.  A zero value uses MaxSize.
+	MaxRequestSize int
+
+	// MaxResponseSize is the maximum allowable size of an HTTP Response.  It cannot be larger
+	// than 65507.  A zero value uses MaxSize.  Larger responses are discarded and reported with
+	// a TruncatedError.
+	MaxResponseSize int
+
 	// WaitTime is the default time we will spend waiting for HTTP responses before returning.  A zero
 	// value means wait forever.
 	WaitTime time.Duration
@@ -34,11 +50,154 @@ type Transport struct {
 	// HTTP/1.1 (but let's face it, none of this is standard).
 	HeaderCanon func(name string) string
 
+	// OmitAutoHeaders lists automatically-generated headers that should not be sent.  As with
+	// HeaderCanon, omitting "Host" may break compatibility with HTTP/1.1.
+	OmitAutoHeaders AutoHeader
+
+	// LenientParsing enables a tolerant response parser that corrects common deviations from
+	// HTTP/1.1, such as bare LF line endings or missing reason phrases, that would otherwise
+	// cause responses to be discarded.  The corrections made to each response are reported in
+	// its ResponseInfo.Quirks.
+	LenientParsing bool
+
+	// Fragmentation enables an extension, understood only by uhttp servers, that allows request
+	// and response bodies to span several datagrams.  Requests too large for MaxRequestSize are
+	// split into numbered fragments, and the server is told that fragmented responses are
+	// acceptable.  Fragmented responses are reassembled before they are delivered, and lost
+	// fragments are retransmitted on request.
+	Fragmentation bool
+
+	// MaxMessageSize is the maximum size of a fragmented request or response.  A zero value
+	// will use the default of 1MB.
+	MaxMessageSize int
+
+	// FragmentTimeout is how long to wait for the missing fragments of a message before giving up
+	// on it.  Retransmission is requested several times within this period.  A zero value will
+	// use the default of 2s.
+	FragmentTimeout time.Duration
+
+	// Compression enables transparent decompression of responses.  Requests are sent with
+	// "Accept-Encoding: gzip, deflate" unless they already carry an Accept-Encoding header, and
+	// responses with a gzip or deflate Content-Encoding are decompressed before delivery, with
+	// Content-Encoding removed and http.Response.Uncompressed set.
+	Compression bool
+
+	// RequestEncoding, if set to "gzip" or "deflate", compresses request bodies with that content
+	// coding.  Requests that already carry a Content-Encoding header are sent as is.
+	RequestEncoding string
+
+	// MaxDecompressedSize is the maximum size of a response body after decompression, and of a
+	// request body before compression.  Responses that would decompress to more than this are
+	// discarded.  A zero value will use the default of 1MB.
+	MaxDecompressedSize int
+
+	// MaxParsedResponses limits the number of packets parsed for each request.  Further packets
+	// are dropped unread, but unlike CollectOptions.MaxResponses, reaching the limit doesn't end
+	// the round trip.  A zero value means no limit.
+	MaxParsedResponses int
+
+	// MaxParsedResponsesPerSender limits the number of packets parsed from each sender IP
+	// address for each request.  Only the first 1024 senders are counted separately; any others
+	// share a single limit.  A zero value means no limit.
+	MaxParsedResponsesPerSender int
+
+	// ReceiveRate limits the rate, in packets per second, at which packets are parsed for each
+	// request, with bursts of up to ReceiveBurst packets.  Packets arriving faster are dropped
+	// unread.  A zero value means no limit.
+	//
+	// Packets dropped because of these limits are counted in Metrics and reported to
+	// ClientTrace.Finished.  Each fragment of a fragmented response counts as a packet.
+	ReceiveRate  float64
+	ReceiveBurst int
+
+	// Signer, if non-nil, signs requests and verifies the signatures of responses, which must
+	// come from a Server using a Signer with the same keys.  Responses that fail verification are
+	// rejected as with AcceptFrom, with reason RejectBadSignature.  Requests are refused if
+	// HeaderCanon would omit or rename a signed header.
+	Signer *Signer
+
+	// AcceptFrom, if non-nil, restricts the senders from which responses are accepted.
+	// Rejected packets are counted in Metrics and reported to ClientTrace.PacketRejected.
+	AcceptFrom *AcceptPolicy
+
+	// DialContext, if non-nil, is used to open the connection for unicast requests in place of
+	// net.Dialer.  Each datagram read from or written to the connection must carry a single
+	// message.  Package uhttpdtls provides one that secures requests with DTLS.  It can't be
+	// combined with LocalAddr.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// LocalAddr, if set, is the local address, such as ":1900", from which requests are sent and
+	// on which responses are received, in place of a system-assigned port.  This helps with
+	// devices that reply to the SSDP port rather than to the port a request came from.  The
+	// socket is opened with SO_REUSEADDR and SO_REUSEPORT so that it may coexist with other SSDP
+	// agents on the host, and is shared by all requests in the process using the same LocalAddr.
+	// Each such request sees every packet received while it is waiting.  It can't be combined
+	// with DialContext, since requests would then not be sent over the dialed connection.
+	LocalAddr string
+
 	// Repeat enables requests to be repeated, according to the delays returned by the resulting
 	// RepeatFunc.
 	Repeat RepeatGenerator
 
-	bufPool sync.Pool
+	// Clock is used for wait windows and repeat timers.  A nil value uses SystemClock.
+	Clock Clock
+
+	// Metrics, if non-nil, receives counters and observations about requests and responses.
+	Metrics Metrics
+
+	// Logger, if non-nil, records socket setup, sends, repeats, received packets, parse failures
+	// and wait expiry.  Records carry a request_id attribute that is unique to each round trip.
+	// Packet contents are included as hex dumps when the debug level is enabled.
+	Logger *slog.Logger
+
+	bufPool  sync.Pool
+	recvPool sync.Pool
+}
+
+func (t *Transport) clock() Clock {
+	if t.Clock != nil {
+		return t.Clock
+	}
+	return SystemClock
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func (t *Transport) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return discardLogger
+}
+
+// lastRequestID is used to assign each round trip a unique ID for logging.
+var lastRequestID atomic.Uint64
+
+// logPacket logs a packet of data received from sender at level, including a hex dump of its
+// contents if debug logging is enabled.
+func logPacket(ctx context.Context, log *slog.Logger, level slog.Level, msg string, sender net.Addr, data []byte, attrs ...slog.Attr) {
+	if !log.Enabled(ctx, level) {
+		return
+	}
+	attrs = append(attrs, slog.String("sender", sender.String()), slog.Int("bytes", len(data)))
+	if log.Enabled(ctx, slog.LevelDebug) {
+		attrs = append(attrs, slog.String("data", hex.Dump(data)))
+	}
+	log.LogAttrs(ctx, level, msg, attrs...)
+}
+
+func (t *Transport) metrics() Metrics {
+	if t.Metrics != nil {
+		return t.Metrics
+	}
+	return nopMetrics{}
+}
+
+// sent records n bytes sent for counter, which counts requests or repeats.
+func (t *Transport) sent(counter string, n int) {
+	m := t.metrics()
+	m.Add(counter, 1)
+	m.Add(MetricBytesSent, int64(n))
 }
 
 func (t *Transport) getMaxSize() int {
@@ -48,6 +207,47 @@ func (t *Transport) getMaxSize() int {
 	return defaultPacketSize
 }
 
+func (t *Transport) maxRequestSize() int {
+	if t.MaxRequestSize > 0 {
+		return t.MaxRequestSize
+	}
+	return t.getMaxSize()
+}
+
+func (t *Transport) maxMessageSize() int {
+	if t.MaxMessageSize > 0 {
+		return t.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+func (t *Transport) maxResponseSize() int {
+	if t.MaxResponseSize > 0 {
+		return t.MaxResponseSize
+	}
+	return t.getMaxSize()
+}
+
+// validate ensures the size limits in t are usable.
+func (t *Transport) validate() error {
+	if t.MaxSize < 0 || t.MaxRequestSize < 0 || t.MaxResponseSize < 0 {
+		return errors.New("uhttp: negative Transport size limit")
+	}
+	if n := t.maxRequestSize(); n > maxPacketSize {
+		return fmt.Errorf("uhttp: request size limit %d exceeds UDP limit of %d", n, maxPacketSize)
+	}
+	if n := t.maxResponseSize(); n > maxPacketSize {
+		return fmt.Errorf("uhttp: response size limit %d exceeds UDP limit of %d", n, maxPacketSize)
+	}
+	if t.RequestEncoding != "" && !validEncoding(t.RequestEncoding) {
+		return fmt.Errorf("uhttp: unsupported RequestEncoding %q", t.RequestEncoding)
+	}
+	if t.LocalAddr != "" && t.DialContext != nil {
+		return errors.New("uhttp: Transport.LocalAddr and DialContext can't both be set")
+	}
+	return nil
+}
+
 type RoundTripMultier interface {
 	http.RoundTripper
 
@@ -64,19 +264,37 @@ var DefaultTransport RoundTripMultier = &Transport{
 	WaitTime: 3 * time.Second,
 }
 
-func (t *Transport) newBuf() []byte {
+func (t *Transport) newBuf() *[]byte {
 	if b := t.bufPool.Get(); b != nil {
-		return b.([]byte)
+		return b.(*[]byte)
 	}
 	// We don't use pool.New since t.MaxSize is a field of Transport and this simplifies
 	// initialization.
-	return make([]byte, t.getMaxSize())
+	b := make([]byte, t.maxRequestSize())
+	return &b
 }
 
-func (t *Transport) releaseBuf(b []byte) {
+// releaseBuf returns b to the pool.  Callers that grew the buffer should store the grown slice
+// in *b first, so that the pool keeps it.
+func (t *Transport) releaseBuf(b *[]byte) {
 	t.bufPool.Put(b)
 }
 
+// newRecvBuf returns a buffer for receiving responses.  It is one byte larger than the
+// response size limit, so that a response that exceeds it can be detected, rather than being
+// silently truncated by the operating system.
+func (t *Transport) newRecvBuf() *[]byte {
+	if b := t.recvPool.Get(); b != nil {
+		return b.(*[]byte)
+	}
+	b := make([]byte, t.maxResponseSize()+1)
+	return &b
+}
+
+func (t *Transport) releaseRecvBuf(b *[]byte) {
+	t.recvPool.Put(b)
+}
+
 type timeoutErr string
 
 func (e timeoutErr) Error() string   { return string(e) }
@@ -84,20 +302,28 @@ func (e timeoutErr) Timeout() bool   { return true }
 func (e timeoutErr) Temporary() bool { return true }
 
 var ErrTimeout error = timeoutErr("timeout waiting for responses")
+var ErrRequestTooLarge = errors.New("uhttp: http.Request does not fit in MaxSize")
+var ErrTruncated = errors.New("uhttp: response truncated")
 var Stop = errors.New("stop processing")
 
+// TruncatedError reports a response that was discarded because it was larger than the
+// Transport's response size limit.  It matches ErrTruncated with errors.Is.
+type TruncatedError struct {
+	Sender net.Addr
+	Limit  int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("uhttp: response from %v truncated: larger than MaxResponseSize of %d", e.Sender, e.Limit)
+}
+
+func (e *TruncatedError) Is(target error) bool { return target == ErrTruncated }
+
 // RoundTrip issues a UDP HTTP request and waits for a single response.  Returns
 // when a response was received, when the req.Context() expires, or when
 // t.MaxWait is reached (if non-zero).
-func (t *Transport) RoundTrip(req *http.Request) (res *http.Response, err error) {
-	err = t.RoundTripMulti(req, 0, func(_ net.Addr, r *http.Response) error {
-		res = r
-		return Stop
-	})
-	if res == nil && err == nil {
-		err = ErrTimeout
-	}
-	return
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return roundTripFirst(t, req)
 }
 
 func validateRequest(req *http.Request) error {
@@ -110,6 +336,13 @@ func validateRequest(req *http.Request) error {
 	if req.Header == nil {
 		return errors.New("uhttp: nil http.Request.Header")
 	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if !httpguts.ValidHostHeader(removeZone(host)) {
+		return fmt.Errorf("uhttp: invalid Host %q", host)
+	}
 	for k, vals := range req.Header {
 		if !httpguts.ValidHeaderFieldName(k) {
 			return fmt.Errorf("uhttp: invalid header field name %q", k)
@@ -120,111 +353,227 @@ func validateRequest(req *http.Request) error {
 			}
 		}
 	}
+	for _, f := range ContextOrderedHeader(req.Context()) {
+		if !httpguts.ValidHeaderFieldName(f.Name) {
+			return fmt.Errorf("uhttp: invalid ordered header field name %q", f.Name)
+		}
+		if !httpguts.ValidHeaderFieldValue(f.Value) {
+			return fmt.Errorf("uhttp: invalid ordered header field value %q for key %v", f.Value, f.Name)
+		}
+	}
 	return nil
 }
 
-// repeat repeats fn for every durFn call that returns a non-nil delay time.  Returns when
-// ctx expires, durFn returns nil, or fn returns an error.
-func repeat(ctx context.Context, durFn func(_ time.Duration) *time.Duration, fn func() error) error {
+// repeat repeats fn for every durFn call that returns a non-nil delay time, using clock to
+// wait out each delay.  Returns when ctx expires, durFn returns nil, or fn returns an error.
+// Each successful repeat is reported to the ClientTrace associated with ctx.
+func repeat(ctx context.Context, clock Clock, durFn func(_ time.Duration) *time.Duration, fn func(n int) error) error {
+	trace := ContextClientTrace(ctx)
 	prev := time.Duration(0)
-	for next := durFn(prev); next != nil; next = durFn(prev) {
+	for n, next := 1, durFn(prev); next != nil; n, next = n+1, durFn(prev) {
 		prev = *next
+		timer := clock.NewTimer(*next)
 		select {
-		case <-time.After(*next):
-			if err := fn(); err != nil {
+		case <-timer.C():
+			if err := fn(n); err != nil {
 				return err
 			}
+			trace.repeatSent(n)
 		case <-ctx.Done():
+			timer.Stop()
 			return nil
 		}
 	}
 	return nil
 }
 
-func (t *Transport) sendDirect(ctx context.Context, address string, data []byte) (n int, conn net.PacketConn, err error) {
+// writePackets writes each of packets using write, and returns the total bytes written.
+func writePackets(write func([]byte) (int, error), packets [][]byte) (total int, err error) {
+	for _, p := range packets {
+		n, err := write(p)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (t *Transport) sendDirect(ctx context.Context, log *slog.Logger, repeats *sync.WaitGroup, address string, packets [][]byte) (n int, conn net.PacketConn, err error) {
 	// Listen on a new UDP socket with a system-assigned local port number, "connected" to the
 	// remote unicast UDP endpoint.
-	var d net.Dialer
-	c, err := d.DialContext(ctx, "udp", address)
+	dial := t.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	c, err := dial(ctx, "udp", address)
 	if err != nil {
 		return 0, nil, fmt.Errorf("uhttp: dial %q: %v", address, err)
 	}
-	conn = c.(net.PacketConn)
+	conn = packetConn(c)
+	trace := ContextClientTrace(ctx)
+	trace.socketOpened(conn.LocalAddr())
+	log.DebugContext(ctx, "uhttp: socket opened", "local", conn.LocalAddr().String())
 
 	// Send the request.
-	if n, err = c.Write(data); err != nil {
+	if n, err = writePackets(c.Write, packets); err != nil {
 		conn.Close()
 		err = fmt.Errorf("uhttp: write request to %q: %v", address, err)
 		conn = nil
 		return
 	}
+	trace.requestWritten(n)
+	log.DebugContext(ctx, "uhttp: request sent", "bytes", n)
 
 	if t.Repeat != nil {
 		// Send duplicate requests if requested.  This goroutine will continue running based on the behavior of
-		// t.Repeat and will automatically exit when ctx expires.
-		go repeat(ctx, t.Repeat(), func() error {
-			_, err := c.Write(data)
-			return err
-		})
+		// t.Repeat and will automatically exit when ctx expires, which the caller waits for in repeats.
+		repeats.Add(1)
+		go func() {
+			defer repeats.Done()
+			repeat(ctx, t.clock(), t.Repeat(), func(num int) error {
+				n, err := writePackets(c.Write, packets)
+				if err != nil {
+					log.DebugContext(ctx, "uhttp: repeat failed", "repeat", num, "error", err)
+					return err
+				}
+				t.sent(MetricRepeatsSent, n)
+				log.DebugContext(ctx, "uhttp: repeat sent", "repeat", num, "bytes", n)
+				return nil
+			})
+		}()
 	}
 	return
 }
 
-func (t *Transport) sendMulti(ctx context.Context, addr *net.UDPAddr, data []byte) (n int, conn net.PacketConn, err error) {
-	// Listen on all addresses with a request-specific system-assigned UDP port number.
-	conn, err = net.ListenPacket("udp", "")
+func (t *Transport) sendMulti(ctx context.Context, log *slog.Logger, repeats *sync.WaitGroup, addr *net.UDPAddr, packets [][]byte) (n int, conn net.PacketConn, err error) {
+	if t.LocalAddr != "" {
+		conn, err = listenShared(t.LocalAddr)
+	} else {
+		// Listen on all addresses with a request-specific system-assigned UDP port number.
+		conn, err = net.ListenPacket("udp", "")
+	}
 	if err != nil {
 		err = fmt.Errorf("uhttp: listen: %v", err)
 		return
 	}
+	trace := ContextClientTrace(ctx)
+	trace.socketOpened(conn.LocalAddr())
+	log.DebugContext(ctx, "uhttp: socket opened", "local", conn.LocalAddr().String())
+
+	write := func(b []byte) (int, error) { return conn.WriteTo(b, addr) }
 
 	// Send the request.
-	if n, err = conn.WriteTo(data, addr); err != nil {
+	if n, err = writePackets(write, packets); err != nil {
 		conn.Close()
 		err = fmt.Errorf("uhttp: write request to %q: %v", addr, err)
 		conn = nil
 		return
 	}
+	trace.requestWritten(n)
+	log.DebugContext(ctx, "uhttp: request sent", "bytes", n)
 
 	if t.Repeat != nil {
 		// Send duplicate requests if requested.  This goroutine will continue running based on the behavior of
-		// t.Repeat and will automatically exit when ctx expires.
-		go repeat(ctx, t.Repeat(), func() error {
-			_, err := conn.WriteTo(data, addr)
-			return err
-		})
+		// t.Repeat and will automatically exit when ctx expires, which the caller waits for in repeats.
+		repeats.Add(1)
+		go func() {
+			defer repeats.Done()
+			repeat(ctx, t.clock(), t.Repeat(), func(num int) error {
+				n, err := writePackets(write, packets)
+				if err != nil {
+					log.DebugContext(ctx, "uhttp: repeat failed", "repeat", num, "error", err)
+					return err
+				}
+				t.sent(MetricRepeatsSent, n)
+				log.DebugContext(ctx, "uhttp: repeat sent", "repeat", num, "bytes", n)
+				return nil
+			})
+		}()
 	}
 	return
 }
 
 // WriteRequest writes req to w, in wire format.  If req is larger than t.MaxSize, returns
-// an error.  This applies header canonicalization per t.HeaderCanon, if it's provided.
+// an error.  This applies header canonicalization per t.HeaderCanon, if it's provided, and
+// omits automatic headers per t.OmitAutoHeaders.
 func (t *Transport) WriteRequest(w io.Writer, req *http.Request) error {
-	w = &limitedWriter{Writer: w, N: t.getMaxSize()}
-
-	var wc io.WriteCloser
-	if t.HeaderCanon != nil {
-		wc = newHeaderCanon(t.HeaderCanon, w)
-		w = wc
+	err := t.validate()
+	if err == nil {
+		err = validateRequest(req)
 	}
-
-	if err := req.Write(w); err != nil {
-		if err == io.ErrShortWrite {
-			return fmt.Errorf("uhttp: http.Request does not fit in MaxSize of %d", t.MaxSize)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
 		}
 		return err
 	}
-	if wc != nil {
-		wc.Close()
+	req, _, err = t.encodeRequest(req)
+	if err != nil {
+		return err
 	}
-	return nil
+	b := t.newBuf()
+	defer t.releaseBuf(b)
+	data, err := t.appendRequest((*b)[:0], req, t.maxRequestSize())
+	if err != nil {
+		return err
+	}
+	*b = data[:0]
+	_, err = w.Write(data)
+	return err
+}
+
+// finished reports stats at the end of a round trip.
+func (t *Transport) finished(ctx context.Context, log *slog.Logger, stats RoundTripStats) {
+	t.metrics().Observe(MetricResponses, float64(stats.Responses))
+	ContextClientTrace(ctx).finished(stats)
+	if n := stats.Dropped(); n > 0 {
+		log.WarnContext(ctx, "uhttp: packets dropped", "dropped", n, "packets", stats.Packets,
+			"over_max", stats.DroppedOverMax, "over_per_sender", stats.DroppedOverPerSender, "over_rate", stats.DroppedOverRate)
+	}
+}
+
+// rejected records that a packet from sender was discarded per t.AcceptFrom.
+func (t *Transport) rejected(ctx context.Context, log *slog.Logger, sender net.Addr, reason RejectReason) {
+	ContextClientTrace(ctx).packetRejected(sender, reason)
+	t.metrics().Add(MetricRejected, 1)
+	log.DebugContext(ctx, "uhttp: packet rejected", "sender", sender.String(), "reason", reason.String())
+}
+
+// serializeRequest writes req, already prepared by encodeRequest, into the buffer buf in wire
+// format, returning the datagrams to send.  If buf had to grow, *buf is updated so that the
+// larger buffer is reused.  If t.Fragmentation is set and req does not fit in a single
+// datagram, it is split into fragments, and the ID of the fragmented message is returned.
+func (t *Transport) serializeRequest(buf *[]byte, req *http.Request) (msgID string, packets [][]byte, err error) {
+	limit := t.maxRequestSize()
+	if t.Fragmentation {
+		limit = t.maxMessageSize()
+	}
+	data, err := t.appendRequest((*buf)[:0], req, limit)
+	if err != nil {
+		return "", nil, err
+	}
+	*buf = data[:0]
+	if !t.Fragmentation {
+		return "", [][]byte{data}, nil
+	}
+	if len(data) <= t.maxRequestSize() {
+		return "", [][]byte{data}, nil
+	}
+	msgID = newMessageID()
+	packets, err = splitMessage(data, msgID, t.maxRequestSize())
+	return msgID, packets, err
 }
 
 // RoundTripMulti issues a UDP HTTP request and calls fn for each response received.  Returns when wait
 // is reached (no error), req.Context() expires, an error occurs, or when fn returns an error.  The
 // sentinal error Stop may be returned by fn to cause this method to return immediately without error.
 func (t *Transport) RoundTripMulti(req *http.Request, wait time.Duration, fn func(sender net.Addr, r *http.Response) error) (err error) {
-	if err = validateRequest(req); err != nil {
+	if err = t.validate(); err == nil {
+		err = validateRequest(req)
+	}
+	if err != nil {
 		if req.Body != nil {
 			req.Body.Close()
 		}
@@ -233,14 +582,30 @@ func (t *Transport) RoundTripMulti(req *http.Request, wait time.Duration, fn fun
 
 	ctx, cancel := context.WithCancel(req.Context())
 	defer cancel()
-
-	// Grab a []byte buffer and write req into it.
-	b := t.newBuf()
-	defer func() { t.releaseBuf(b) }()
-	buf := bytes.NewBuffer(b[:0])
-	if err = t.WriteRequest(buf, req); err != nil {
+	trace := ContextClientTrace(ctx)
+	metrics := t.metrics()
+
+	// Grab a []byte buffer and write req into it.  Repeats are sent from this buffer.
+	reqBuf := t.newBuf()
+	defer t.releaseBuf(reqBuf)
+	var repeats sync.WaitGroup
+	defer func() {
+		// Stop repeating before reqBuf is released.
+		cancel()
+		repeats.Wait()
+	}()
+	sent, nonce, err := t.encodeRequest(req)
+	if err != nil {
+		return err
+	}
+	msgID, packets, err := t.serializeRequest(reqBuf, sent)
+	if err != nil {
 		return err
 	}
+	size := 0
+	for _, p := range packets {
+		size += len(p)
+	}
 
 	var conn net.PacketConn
 	var n int
@@ -248,43 +613,79 @@ func (t *Transport) RoundTripMulti(req *http.Request, wait time.Duration, fn fun
 	if err != nil {
 		return fmt.Errorf("uhttp: resolve %q: %v", req.URL.Host, err)
 	}
+	trace.resolved(raddr)
+	log := t.logger().With(slog.Uint64("request_id", lastRequestID.Add(1)), slog.String("dest", raddr.String()))
+	if raddr.Zone != "" {
+		log = log.With(slog.String("iface", raddr.Zone))
+	}
 
 	// If the request is intended for a multicast group, we need to explicitly
 	// listen and receive packets from arbitrary responders.  Otherwise, we use
 	// Dial so that we can get 'connection refused' errors and automatic
 	// filtering of responses that don't come from the server.
-	if raddr.IP.Equal(net.IPv4bcast) || raddr.IP.IsMulticast() {
-		n, conn, err = t.sendMulti(ctx, raddr, buf.Bytes())
+	// A fixed LocalAddr also requires an unconnected socket, since replies may not come from the
+	// address we sent to.
+	if raddr.IP.Equal(net.IPv4bcast) || raddr.IP.IsMulticast() || t.LocalAddr != "" {
+		n, conn, err = t.sendMulti(ctx, log, &repeats, raddr, packets)
 	} else {
-		n, conn, err = t.sendDirect(ctx, req.URL.Host, buf.Bytes())
+		n, conn, err = t.sendDirect(ctx, log, &repeats, req.URL.Host, packets)
 	}
 	if err != nil {
+		log.WarnContext(ctx, "uhttp: send failed", "error", err)
 		return fmt.Errorf("uhttp send request: %v", err)
 	}
-	defer conn.Close()
 
-	if n != buf.Len() {
+	if n != size {
 		// Shouldn't normally happen.
-		panic(fmt.Sprintf("udp attempted to write %d bytes, wrote %d", buf.Len(), n))
+		panic(fmt.Sprintf("udp attempted to write %d bytes, wrote %d", size, n))
 	}
+	t.sent(MetricRequestsSent, n)
+	sentAt := t.clock().Now()
+	var stats RoundTripStats
+	defer func() { t.finished(ctx, log, stats) }()
+	limiter := t.newReceiveLimiter()
 
 	type packet struct {
-		addr net.Addr
-		data []byte
-		err  error
+		addr      net.Addr
+		ifIndex   int
+		data      []byte
+		truncated bool
+		err       error
 	}
 
-	// Read from conn in a goroutine, until conn is closed.
+	// Read from conn in a goroutine, until conn is closed.  Each packet is copied out of the
+	// receive buffer, since fn may read its body long after the buffer has been reused.
+	limit := t.maxResponseSize()
+	recvBuf := t.newRecvBuf()
 	ch := make(chan *packet)
+	readerDone := make(chan struct{})
+	readFrom := t.reader(conn) // before sending, so that no response misses its interface
 	go func() {
+		defer close(readerDone)
+		b := *recvBuf
 		for {
-			n, addr, err := conn.ReadFrom(b)
-			ch <- &packet{addr, b[:n], err}
+			n, ifIndex, addr, err := readFrom(b)
+			p := &packet{addr: addr, ifIndex: ifIndex, err: err}
+			if n > limit {
+				p.truncated = true
+			} else {
+				p.data = append([]byte(nil), b[:n]...)
+			}
+			select {
+			case ch <- p:
+			case <-ctx.Done():
+				return
+			}
 			if err != nil {
-				break
+				return
 			}
 		}
-		close(ch)
+	}()
+	defer func() {
+		cancel()
+		conn.Close()
+		<-readerDone
+		t.releaseRecvBuf(recvBuf)
 	}()
 
 	if wait == 0 {
@@ -292,7 +693,26 @@ func (t *Transport) RoundTripMulti(req *http.Request, wait time.Duration, fn fun
 	}
 	var waitCh <-chan time.Time
 	if wait > 0 {
-		waitCh = time.After(wait)
+		timer := t.clock().NewTimer(wait)
+		defer timer.Stop()
+		waitCh = timer.C()
+	}
+
+	accept := newAcceptor(t.AcceptFrom, raddr)
+	var resends *resendLimiter // for RESENDs of a fragmented request, created on first use
+
+	// Fragmented responses are collected here until complete, with fragTimer prompting us to
+	// request any pieces that go missing.
+	var reasm *reassembler
+	var fragTimer Timer
+	var fragCh <-chan time.Time
+	if t.Fragmentation {
+		reasm = newReassembler(t.maxMessageSize(), t.FragmentTimeout)
+		defer func() {
+			if fragTimer != nil {
+				fragTimer.Stop()
+			}
+		}()
 	}
 
 forloop:
@@ -302,7 +722,24 @@ forloop:
 			err = ctx.Err()
 			break forloop
 		case <-waitCh:
+			trace.waitExpired()
+			log.DebugContext(ctx, "uhttp: wait expired", "wait", wait, "responses", stats.Responses)
 			break forloop
+		case <-fragCh:
+			resends, expired := reasm.poll(t.clock().Now())
+			for _, rr := range resends {
+				log.DebugContext(ctx, "uhttp: requesting missing fragments", "sender", rr.sender.String(), "missing", rr.missing)
+				writeTo(conn, newResend(rr.id, rr.missing), rr.sender)
+			}
+			for _, sender := range expired {
+				err = fmt.Errorf("%w from %v", ErrFragmentTimeout, sender)
+				log.WarnContext(ctx, "uhttp: fragmented response expired", "sender", sender.String())
+			}
+			if reasm.pending() {
+				fragTimer.Reset(reasm.interval())
+			} else {
+				fragTimer, fragCh = nil, nil
+			}
 		case p := <-ch:
 			if p == nil {
 				// Channel was closed.  We shouldn't normally get here since the next case is
@@ -315,12 +752,100 @@ forloop:
 				break forloop
 			}
 
-			r, er := http.ReadResponse(bufio.NewReader(bytes.NewReader(p.data)), req)
+			if p.truncated {
+				err = &TruncatedError{Sender: p.addr, Limit: limit}
+				trace.parseFailed(p.addr, err)
+				metrics.Add(MetricTruncated, 1)
+				log.WarnContext(ctx, "uhttp: response truncated", "sender", p.addr.String(), "limit", limit)
+				// As with a parse failure, wait to see if more arrive.
+				continue
+			}
+
+			trace.packetReceived(p.addr, len(p.data))
+			metrics.Add(MetricPacketsReceived, 1)
+			metrics.Add(MetricBytesReceived, int64(len(p.data)))
+			logPacket(ctx, log, slog.LevelDebug, "uhttp: packet received", p.addr, p.data)
+			stats.Packets++
+			if reason := accept.checkSender(p.addr, p.ifIndex); reason != 0 {
+				stats.Rejected++
+				t.rejected(ctx, log, p.addr, reason)
+				continue
+			}
+			if !limiter.admit(t.clock().Now(), p.addr, &stats) {
+				metrics.Add(MetricDropped, 1)
+				continue
+			}
+
+			if msgID != "" && isResend(p.data) {
+				// The server lost some of our request.
+				if rr, er := http.ReadRequest(bufio.NewReader(bytes.NewReader(p.data))); er == nil {
+					if id, missing := parseResend(rr); id == msgID {
+						if resends == nil {
+							resends = newResendLimiter(raddr, size)
+						}
+						if !resends.allow(p.addr, packets, missing) {
+							metrics.Add(MetricAmplificationLimited, 1)
+							log.DebugContext(ctx, "uhttp: RESEND ignored", "sender", p.addr.String(), "missing", missing)
+							continue
+						}
+						log.DebugContext(ctx, "uhttp: resending fragments", "sender", p.addr.String(), "missing", missing)
+						resendFragments(conn, p.addr, packets, missing)
+					}
+				}
+				continue
+			}
+			r, er := t.parseResponse(p.addr, p.data, req)
 			if er != nil {
-				err = fmt.Errorf("uhttp: parse response: %v", err)
+				err = fmt.Errorf("uhttp: parse response: %v", er)
+				trace.parseFailed(p.addr, er)
+				metrics.Add(MetricParseFailures, 1)
+				logPacket(ctx, log, slog.LevelWarn, "uhttp: parse response failed", p.addr, p.data, slog.Any("error", er))
 				// Discard this packet and wait to see if more arrive.  If none do, this error will stand.
 				continue
 			}
+			if reasm != nil {
+				if id, index, count, ok := parseFragment(r.Header); ok {
+					body, _ := io.ReadAll(r.Body)
+					head, full, er := reasm.add(t.clock().Now(), p.addr, true, id, index, count, r, body)
+					if er != nil {
+						err = fmt.Errorf("%w from %v", er, p.addr)
+						continue
+					}
+					if head == nil {
+						if fragTimer == nil {
+							fragTimer = t.clock().NewTimer(reasm.interval())
+							fragCh = fragTimer.C()
+						}
+						continue
+					}
+					r = head.(*http.Response)
+					r.Body, r.ContentLength = stripFragmentHeaders(r.Header, full)
+				}
+			}
+			if t.Signer != nil {
+				if er := t.Signer.verifyResponse(r, nonce, t.maxMessageSize()); er != nil {
+					err = fmt.Errorf("%w from %v", er, p.addr)
+					stats.Rejected++
+					metrics.Add(MetricSignatureFailures, 1)
+					t.rejected(ctx, log, p.addr, RejectBadSignature)
+					continue
+				}
+			}
+			if er := t.decodeResponse(r); er != nil {
+				err = fmt.Errorf("%w from %v", er, p.addr)
+				metrics.Add(MetricParseFailures, 1)
+				trace.parseFailed(p.addr, er)
+				log.WarnContext(ctx, "uhttp: decode response failed", "sender", p.addr.String(), "error", er)
+				continue
+			}
+			if reason := accept.checkResponse(p.addr, r); reason != 0 {
+				stats.Rejected++
+				t.rejected(ctx, log, p.addr, reason)
+				continue
+			}
+			trace.responseParsed(p.addr, r)
+			metrics.Observe(MetricResponseLatency, t.clock().Now().Sub(sentAt).Seconds())
+			stats.Responses++
 			if err = fn(p.addr, r); err != nil {
 				break forloop
 			}
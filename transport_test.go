@@ -1,15 +1,432 @@
 package uhttp_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strings"
+	"testing"
 	"time"
 
 	"github.com/dnesting/uhttp"
+	"github.com/dnesting/uhttp/uhttptest"
 )
 
+// listenUDP starts a UDP listener on the loopback interface that reports each packet it
+// receives on the returned channel.  If respond is non-nil, its result is sent back to the
+// sender.
+func listenUDP(t *testing.T, respond func(data []byte) []byte) (string, <-chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ch := make(chan []byte, 100)
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				close(ch)
+				return
+			}
+			data := append([]byte(nil), b[:n]...)
+			ch <- data
+			if respond != nil {
+				if res := respond(data); res != nil {
+					conn.WriteTo(res, addr)
+				}
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), ch
+}
+
+func TestTransportFakeClock(t *testing.T) {
+	addr, packets := listenUDP(t, func([]byte) []byte {
+		return []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	clock := uhttptest.NewFakeClock(time.Now())
+	tr := &uhttp.Transport{
+		Clock:  clock,
+		Repeat: uhttp.RepeatAfter(time.Second, 2),
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+
+	responses := make(chan *http.Response, 10)
+	done := make(chan error)
+	go func() {
+		done <- tr.RoundTripMulti(req, 10*time.Second, func(_ net.Addr, r *http.Response) error {
+			responses <- r
+			return nil
+		})
+	}()
+
+	// The initial request, then two repeats as the clock advances.  Each time, both the wait
+	// timer and the repeat timer should be pending.
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			clock.BlockUntil(2)
+			clock.Advance(time.Second)
+		}
+		<-packets
+		if r := <-responses; r.StatusCode != 200 {
+			t.Errorf("expected status 200, got %d", r.StatusCode)
+		}
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("RoundTripMulti returned before wait expired: %v", err)
+	default:
+	}
+
+	clock.Advance(8 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("expected no error after wait expired, got %v", err)
+	}
+	select {
+	case <-packets:
+		t.Errorf("expected no further repeats")
+	default:
+	}
+}
+
+func TestTransportMetrics(t *testing.T) {
+	addr, _ := listenUDP(t, func(data []byte) []byte {
+		return []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	m := &uhttp.MemoryMetrics{}
+	tr := &uhttp.Transport{Metrics: m, Repeat: uhttp.RepeatAfter(10*time.Millisecond, 1)}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	err := tr.RoundTripMulti(req, 300*time.Millisecond, func(net.Addr, *http.Response) error { return nil })
+	if err != nil {
+		t.Fatalf("did not expect error, got %v", err)
+	}
+
+	s := m.Snapshot()
+	for name, want := range map[string]int64{
+		uhttp.MetricRequestsSent:    1,
+		uhttp.MetricRepeatsSent:     1,
+		uhttp.MetricPacketsReceived: 2,
+		uhttp.MetricBytesReceived:   76,
+	} {
+		if got := s.Counters[name]; got != want {
+			t.Errorf("expected %s to be %d, got %d", name, want, got)
+		}
+	}
+	if got := s.Histograms[uhttp.MetricResponseLatency].Count; got != 2 {
+		t.Errorf("expected 2 latency observations, got %d", got)
+	}
+	if got := s.Histograms[uhttp.MetricResponses]; got.Count != 1 || got.Sum != 2 {
+		t.Errorf("expected a single observation of 2 responses, got %+v", got)
+	}
+
+	req, _ = http.NewRequest("POST", "http://"+addr+"/", strings.NewReader(strings.Repeat("x", 100)))
+	tr = &uhttp.Transport{Metrics: m, MaxSize: 50}
+	if _, err := tr.RoundTrip(req); !errors.Is(err, uhttp.ErrRequestTooLarge) {
+		t.Errorf("expected ErrRequestTooLarge, got %v", err)
+	}
+	if got := m.Snapshot().Counters[uhttp.MetricOversizeRequests]; got != 1 {
+		t.Errorf("expected 1 oversize request, got %d", got)
+	}
+}
+
+func TestTransportLogger(t *testing.T) {
+	var count int
+	addr, _ := listenUDP(t, func([]byte) []byte {
+		if count++; count == 1 {
+			return []byte("garbage")
+		}
+		return []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tr := &uhttp.Transport{Logger: log, Repeat: uhttp.RepeatAfter(10*time.Millisecond, 1)}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	if err := tr.RoundTripMulti(req, 300*time.Millisecond, func(net.Addr, *http.Response) error { return nil }); err != nil {
+		t.Fatalf("did not expect error, got %v", err)
+	}
+
+	var msgs []string
+	var id float64
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		msgs = append(msgs, rec["msg"].(string))
+		if rec["dest"] != addr {
+			t.Errorf("expected dest %q in %v", addr, rec)
+		}
+		if id == 0 {
+			id, _ = rec["request_id"].(float64)
+		} else if rec["request_id"] != id {
+			t.Errorf("expected request_id %v in %v", id, rec)
+		}
+		switch rec["msg"] {
+		case "uhttp: packet received", "uhttp: parse response failed":
+			if rec["sender"] == nil || rec["bytes"] == nil || rec["data"] == nil {
+				t.Errorf("expected sender, bytes and data in %v", rec)
+			}
+		}
+	}
+	// Repeats are logged from another goroutine, so only the counts are deterministic.
+	expected := map[string]int{
+		"uhttp: socket opened":         1,
+		"uhttp: request sent":          1,
+		"uhttp: repeat sent":           1,
+		"uhttp: packet received":       2,
+		"uhttp: parse response failed": 1,
+		"uhttp: wait expired":          1,
+	}
+	actual := make(map[string]int)
+	for _, msg := range msgs {
+		actual[msg]++
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("expected messages %v, got %q", expected, msgs)
+	}
+	if msgs[0] != "uhttp: socket opened" || msgs[len(msgs)-1] != "uhttp: wait expired" {
+		t.Errorf("expected socket setup first and wait expiry last, got %q", msgs)
+	}
+}
+
+func TestTransportResponseInfo(t *testing.T) {
+	addr, _ := listenUDP(t, func([]byte) []byte {
+		return []byte("HTTP/1.1 200 OK\r\nST: x\r\nCACHE-CONTROL: max-age=1800\r\nContent-Length: 0\r\n\r\n")
+	})
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	res, err := (&uhttp.Transport{WaitTime: 5 * time.Second}).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("did not expect error, got %v", err)
+	}
+	if res.Request != req {
+		t.Errorf("expected res.Request to be the request given")
+	}
+	info := uhttp.ResponseInfoFor(res)
+	if info == nil {
+		t.Fatalf("expected ResponseInfo for response")
+	}
+	if info.StatusLine != "HTTP/1.1 200 OK" || info.Sender.String() != addr {
+		t.Errorf("expected status line and sender %s, got %q from %v", addr, info.StatusLine, info.Sender)
+	}
+	if got := fmt.Sprint(info.Header); got != "[{ST x} {CACHE-CONTROL max-age=1800} {Content-Length 0}]" {
+		t.Errorf("expected raw header in original order and case, got %s", got)
+	}
+}
+
+func TestTransportSizeLimits(t *testing.T) {
+	big := "HTTP/1.1 200 OK\r\nContent-Length: 200\r\n\r\n" + strings.Repeat("x", 200)
+	addr, _ := listenUDP(t, func(data []byte) []byte {
+		if bytes.HasPrefix(data, []byte("GET /big ")) {
+			return []byte(big)
+		}
+		return []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	// A request larger than MaxResponseSize should be fine if it fits in MaxRequestSize.
+	tr := &uhttp.Transport{MaxRequestSize: 300, MaxResponseSize: 100, WaitTime: 5 * time.Second}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/small", nil)
+	req.Header.Set("X-Padding", strings.Repeat("p", 150))
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Errorf("expected request within MaxRequestSize to succeed, got %v", err)
+	}
+
+	// A response larger than MaxResponseSize should be reported rather than mangled.
+	req, _ = http.NewRequest("GET", "http://"+addr+"/big", nil)
+	err := tr.RoundTripMulti(req, 300*time.Millisecond, func(net.Addr, *http.Response) error {
+		t.Errorf("truncated response should not be delivered")
+		return nil
+	})
+	var te *uhttp.TruncatedError
+	if !errors.Is(err, uhttp.ErrTruncated) || !errors.As(err, &te) {
+		t.Fatalf("expected a TruncatedError, got %v", err)
+	}
+	if te.Sender.String() != addr || te.Limit != 100 {
+		t.Errorf("expected truncation from %s at 100, got %v at %d", addr, te.Sender, te.Limit)
+	}
+
+	// The full response should arrive if the limit allows for it.
+	tr = &uhttp.Transport{MaxRequestSize: 300, MaxResponseSize: len(big), WaitTime: 5 * time.Second}
+	req, _ = http.NewRequest("GET", "http://"+addr+"/big", nil)
+	if res, err := tr.RoundTrip(req); err != nil || res.ContentLength != 200 {
+		t.Errorf("expected response at exactly MaxResponseSize to succeed, got %v", err)
+	}
+
+	for _, tr := range []*uhttp.Transport{
+		{MaxSize: 70000},
+		{MaxRequestSize: 65508},
+		{MaxResponseSize: 65508},
+		{MaxResponseSize: -1},
+	} {
+		req, _ = http.NewRequest("GET", "http://"+addr+"/", nil)
+		if _, err := tr.RoundTrip(req); err == nil {
+			t.Errorf("expected invalid size limits %+v to be rejected", tr)
+		}
+	}
+}
+
+func TestTransportLocalAddr(t *testing.T) {
+	c, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	local := c.LocalAddr().String()
+	c.Close()
+	localAddr, _ := net.ResolveUDPAddr("udp", local)
+
+	// A buggy device that always replies to the local port rather than to the sender.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			if _, _, err := conn.ReadFrom(b); err != nil {
+				return
+			}
+			conn.WriteTo([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), localAddr)
+		}
+	}()
+
+	for _, tc := range []struct {
+		localAddr string
+		want      int
+	}{{"", 0}, {local, 1}} {
+		tr := &uhttp.Transport{LocalAddr: tc.localAddr}
+		req, _ := http.NewRequest("M-SEARCH", "http://"+conn.LocalAddr().String()+"/", nil)
+		n := 0
+		if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("LocalAddr %q: %v", tc.localAddr, err)
+		}
+		if n != tc.want {
+			t.Errorf("LocalAddr %q: got %d responses, want %d", tc.localAddr, n, tc.want)
+		}
+	}
+}
+
+func TestTransportLocalAddrWithDialContext(t *testing.T) {
+	addr, packets := listenUDP(t, nil)
+	tr := &uhttp.Transport{LocalAddr: "127.0.0.1:0", DialContext: func(context.Context, string, string) (net.Conn, error) {
+		t.Error("dialed with LocalAddr set")
+		return nil, errors.New("unexpected dial")
+	}}
+	for _, rt := range []uhttp.RoundTripMultier{tr, &uhttp.Session{Transport: tr}} {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		if err := rt.RoundTripMulti(req, 100*time.Millisecond, func(net.Addr, *http.Response) error { return nil }); err == nil {
+			t.Errorf("%T: RoundTripMulti succeeded with both LocalAddr and DialContext", rt)
+		}
+	}
+	select {
+	case p := <-packets:
+		t.Errorf("request sent in cleartext: %q", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTransportAcceptFrom(t *testing.T) {
+	addr, _ := listenUDP(t, func([]byte) []byte {
+		return []byte("HTTP/1.1 200 OK\r\nLocation: http://192.0.2.1/desc.xml\r\nContent-Length: 0\r\n\r\n")
+	})
+	for _, tc := range []struct {
+		policy *uhttp.AcceptPolicy
+		reason uhttp.RejectReason
+	}{
+		{nil, 0},
+		{&uhttp.AcceptPolicy{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, OnLink: true}, 0},
+		{&uhttp.AcceptPolicy{Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}}, uhttp.RejectDenied},
+		{&uhttp.AcceptPolicy{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, uhttp.RejectNotAllowed},
+		{&uhttp.AcceptPolicy{MatchLocation: true}, uhttp.RejectLocationMismatch},
+	} {
+		m := &uhttp.MemoryMetrics{}
+		tr := &uhttp.Transport{AcceptFrom: tc.policy, Metrics: m}
+		var rejected []uhttp.RejectReason
+		ctx := uhttp.WithClientTrace(context.Background(), &uhttp.ClientTrace{
+			PacketRejected: func(_ net.Addr, reason uhttp.RejectReason) { rejected = append(rejected, reason) },
+		})
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/", nil)
+		n := 0
+		if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if tc.reason != 0 {
+			want = 0
+			if len(rejected) != 1 || rejected[0] != tc.reason {
+				t.Errorf("%+v: rejected %v, want %v", tc.policy, rejected, tc.reason)
+			}
+			if got := m.Snapshot().Counters[uhttp.MetricRejected]; got != 1 {
+				t.Errorf("%+v: %s = %d, want 1", tc.policy, uhttp.MetricRejected, got)
+			}
+		}
+		if n != want {
+			t.Errorf("%+v: got %d responses, want %d", tc.policy, n, want)
+		}
+	}
+}
+
+func TestTransportReceiveLimits(t *testing.T) {
+	// A responder that floods each request with 10 responses.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			_, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			for range 10 {
+				conn.WriteTo([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), addr)
+			}
+		}
+	}()
+
+	m := &uhttp.MemoryMetrics{}
+	tr := &uhttp.Transport{MaxParsedResponsesPerSender: 3, Metrics: m}
+	var stats uhttp.RoundTripStats
+	ctx := uhttp.WithClientTrace(context.Background(), &uhttp.ClientTrace{
+		Finished: func(s uhttp.RoundTripStats) { stats = s },
+	})
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+conn.LocalAddr().String()+"/", nil)
+	n := 0
+	if err := tr.RoundTripMulti(req, 300*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d responses, want 3", n)
+	}
+	if stats.Responses != 3 || stats.DroppedOverPerSender != stats.Packets-3 || stats.Packets < 4 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if got := m.Snapshot().Counters[uhttp.MetricDropped]; got != int64(stats.Dropped()) {
+		t.Errorf("%s = %d, want %d", uhttp.MetricDropped, got, stats.Dropped())
+	}
+}
+
 func ExampleTransport_sSDP() {
 	// This example performs an SSDP M-SEARCH to the local Multicast SSDP address.
 	// It leverages the stock Go http.Client with uhttp.Transport.  Only the first
@@ -40,3 +457,61 @@ func ExampleTransport_sSDP() {
 		resp.Write(os.Stdout)
 	}
 }
+
+// stallConn is a connection whose second write, the first repeat, blocks until release is
+// closed.
+type stallConn struct {
+	net.Conn
+	writes  int
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	if c.writes++; c.writes == 2 {
+		close(c.stalled)
+		<-c.release
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTransportWaitsForRepeat(t *testing.T) {
+	// Repeats are sent from a pooled buffer, so RoundTripMulti mustn't return while one is still
+	// being written.
+	addr, _ := listenUDP(t, nil)
+	newRT := []func(*uhttp.Transport) uhttp.RoundTripMultier{
+		func(tr *uhttp.Transport) uhttp.RoundTripMultier { return tr },
+		func(tr *uhttp.Transport) uhttp.RoundTripMultier { return &uhttp.Session{Transport: tr} },
+	}
+	for _, fn := range newRT {
+		conn := &stallConn{stalled: make(chan struct{}), release: make(chan struct{})}
+		rt := fn(&uhttp.Transport{
+			Repeat: uhttp.RepeatAfter(time.Millisecond, 1),
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				c, err := d.DialContext(ctx, network, address)
+				conn.Conn = c
+				return conn, err
+			},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/", nil)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- rt.RoundTripMulti(req, 10*time.Second, func(net.Addr, *http.Response) error { return nil })
+		}()
+		<-conn.stalled
+		cancel()
+		select {
+		case <-errc:
+			t.Errorf("%T: RoundTripMulti returned while a repeat was being sent", rt)
+			close(conn.release)
+		case <-time.After(50 * time.Millisecond):
+			close(conn.release)
+			<-errc
+		}
+		if s, ok := rt.(*uhttp.Session); ok {
+			s.Close()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package uhttpdtls secures unicast uhttp requests with DTLS, using github.com/pion/dtls.
+//
+// A client sets uhttp.Transport.DialContext to the result of Dialer, and a server passes the
+// listener returned by Listen to uhttp.Server.ServeListener.  Requests and responses are then
+// exchanged exactly as over plain UDP, one message per DTLS record.  Multicast requests can't be
+// secured this way, and are sent as usual.
+//
+// Authentication is configured with the options of package dtls, such as dtls.WithPSK for
+// pre-shared keys or dtls.WithCertificates for certificates.
+package uhttpdtls
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// DefaultHandshakeTimeout bounds a handshake started by Dialer when the request context has no
+// deadline.  A peer that can't authenticate typically stays silent rather than failing the
+// handshake, so without a bound the handshake would be retried indefinitely.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Dialer returns a function, suitable for uhttp.Transport.DialContext, that establishes a DTLS
+// connection with opts.  The handshake is completed before it returns, and is bounded by
+// DefaultHandshakeTimeout if ctx has no deadline of its own.
+func Dialer(opts ...dtls.ClientOption) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		raddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		// pion/dtls wants an unconnected socket.
+		pc, err := net.ListenUDP(network, nil)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dtls.ClientWithOptions(pc, raddr, opts...)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, DefaultHandshakeTimeout)
+			defer cancel()
+		}
+		if err := conn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			pc.Close()
+			return nil, fmt.Errorf("uhttpdtls: handshake with %v: %w", raddr, err)
+		}
+		return conn, nil
+	}
+}
+
+// Listen returns a listener for DTLS connections on address, configured with opts, for use
+// with uhttp.Server.ServeListener.
+func Listen(address string, opts ...dtls.ServerOption) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return dtls.ListenWithOptions("udp", laddr, opts...)
+}
@@ -0,0 +1,134 @@
+package uhttpdtls_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dnesting/uhttp"
+	"github.com/dnesting/uhttp/uhttpdtls"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/selfsign"
+)
+
+// serve starts a uhttp.Server on a DTLS listener configured with opts, and returns its
+// address.
+func serve(t *testing.T, opts ...dtls.ServerOption) string {
+	t.Helper()
+	l, err := uhttpdtls.Listen("127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &uhttp.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte("echo "), b...))
+	})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeListener(l)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+func roundTrip(t *testing.T, addr string, opts ...dtls.ClientOption) (string, error) {
+	t.Helper()
+	// Failed handshakes are only detected by timing out.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tr := &uhttp.Transport{DialContext: uhttpdtls.Dialer(opts...)}
+	req, _ := http.NewRequestWithContext(ctx, "POST", "http://"+addr+"/", bytes.NewReader([]byte("secret")))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	b, _ := io.ReadAll(res.Body)
+	return string(b), nil
+}
+
+func TestPSK(t *testing.T) {
+	psk := func(key string) func([]byte) ([]byte, error) {
+		return func([]byte) ([]byte, error) { return []byte(key), nil }
+	}
+	addr := serve(t,
+		dtls.WithPSK(psk("shared key")),
+		dtls.WithPSKIdentityHint([]byte("server")),
+		dtls.WithCipherSuites(dtls.TLS_PSK_WITH_AES_128_GCM_SHA256),
+	)
+
+	got, err := roundTrip(t, addr,
+		dtls.WithPSK(psk("shared key")),
+		dtls.WithPSKIdentityHint([]byte("client")),
+		dtls.WithCipherSuites(dtls.TLS_PSK_WITH_AES_128_GCM_SHA256),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "echo secret" {
+		t.Errorf("response = %q", got)
+	}
+
+	// Twice, to make sure the server keeps serving after the first connection goes away.
+	if got, err := roundTrip(t, addr,
+		dtls.WithPSK(psk("shared key")),
+		dtls.WithPSKIdentityHint([]byte("client")),
+		dtls.WithCipherSuites(dtls.TLS_PSK_WITH_AES_128_GCM_SHA256),
+	); err != nil || got != "echo secret" {
+		t.Errorf("second request = %q, %v", got, err)
+	}
+
+	if _, err := roundTrip(t, addr,
+		dtls.WithPSK(psk("wrong key")),
+		dtls.WithPSKIdentityHint([]byte("client")),
+		dtls.WithCipherSuites(dtls.TLS_PSK_WITH_AES_128_GCM_SHA256),
+	); err == nil {
+		t.Error("expected failure with the wrong key")
+	}
+}
+
+func TestCertificate(t *testing.T) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, dtls.WithCertificates(cert))
+
+	got, err := roundTrip(t, addr, dtls.WithInsecureSkipVerify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "echo secret" {
+		t.Errorf("response = %q", got)
+	}
+
+	// A client that verifies certificates won't trust this one.
+	if _, err := roundTrip(t, addr, dtls.WithServerName("localhost")); err == nil {
+		t.Error("expected failure verifying a self-signed certificate")
+	}
+}
+
+func TestPlainClientIgnored(t *testing.T) {
+	cert, _ := selfsign.GenerateSelfSigned()
+	addr := serve(t, dtls.WithCertificates(cert))
+
+	tr := &uhttp.Transport{}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	n := 0
+	if err := tr.RoundTripMulti(req, 200*time.Millisecond, func(net.Addr, *http.Response) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("unencrypted request got %d responses", n)
+	}
+}
@@ -0,0 +1,119 @@
+// Package uhttptest provides utilities for testing code that uses uhttp.
+package uhttptest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dnesting/uhttp"
+)
+
+// FakeClock is a uhttp.Clock whose time only moves when Advance is called.  Timers fire
+// synchronously from within Advance.  It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock whose current time is now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the fake current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After is equivalent to NewTimer(d).C().
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer creates a timer that fires once the clock has been advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) uhttp.Timer {
+	t := &fakeTimer{c: c, ch: make(chan time.Time, 1)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers that come due, in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// BlockUntil blocks until at least n timers are waiting to fire.  This lets a test wait for
+// the code under test to reach the point where it is waiting on the clock.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// schedule arranges for t to fire after d.  c.mu must be held.
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+	c.fire()
+	c.cond.Broadcast()
+}
+
+// fire delivers the time to every timer that is due.  c.mu must be held.
+func (c *FakeClock) fire() {
+	for len(c.timers) > 0 && !c.timers[0].when.After(c.now) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+}
+
+// remove unschedules t, returning true if it was pending.  c.mu must be held.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	c    *FakeClock
+	ch   chan time.Time
+	when time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.c.remove(t)
+	t.c.schedule(t, d)
+	return active
+}
@@ -0,0 +1,65 @@
+package uhttptest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	t1 := c.NewTimer(time.Second)
+	t2 := c.NewTimer(3 * time.Second)
+	ch := c.After(2 * time.Second)
+
+	c.Advance(1500 * time.Millisecond)
+	select {
+	case got := <-t1.C():
+		if want := start.Add(1500 * time.Millisecond); !got.Equal(want) {
+			t.Errorf("t1 should fire with %v, got %v", want, got)
+		}
+	default:
+		t.Errorf("t1 should have fired after 1.5s")
+	}
+	select {
+	case <-ch:
+		t.Errorf("After(2s) should not fire after 1.5s")
+	default:
+	}
+
+	if !t2.Stop() {
+		t.Errorf("stopping a pending timer should return true")
+	}
+	if t1.Stop() {
+		t.Errorf("stopping a fired timer should return false")
+	}
+
+	c.Advance(time.Second)
+	<-ch
+	select {
+	case <-t2.C():
+		t.Errorf("stopped timer should not fire")
+	default:
+	}
+
+	if t2.Reset(time.Second) {
+		t.Errorf("resetting a stopped timer should return false")
+	}
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	<-t2.C()
+
+	if got, want := c.Now(), start.Add(3500*time.Millisecond); !got.Equal(want) {
+		t.Errorf("Now should return %v, got %v", want, got)
+	}
+}
+
+func TestFakeClockImmediate(t *testing.T) {
+	c := NewFakeClock(time.Time{})
+	select {
+	case <-c.After(0):
+	default:
+		t.Errorf("a zero-duration timer should fire immediately")
+	}
+}